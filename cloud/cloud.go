@@ -0,0 +1,402 @@
+/*
+Package cloud is Xiaomi cloud account client. It logs in like Mi Home application does and reads device list with
+tokens:
+
+	GET  <account>/pass/serviceLogin?sid=xiaomiio&_json=true        _sign
+	POST <account>/pass/serviceLoginAuth2 user, md5 hash, _sign     ssecurity, userId, location
+	GET  location                                                   serviceToken cookie
+	POST <api>/home/device_list rc4 encrypted params                device list
+
+Api requests are signed with nonce and ssecurity and encrypted with RC4 (first 1024 bytes of key stream dropped).
+*/
+package cloud
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAccountURL = "https://account.xiaomi.com"
+	// DefaultAPIURL is api address, {region} is replaced with "<region>." for all regions except cn
+	DefaultAPIURL = "https://{region}api.io.mi.com/app"
+
+	userAgent  = "Android-7.1.1-1.0.0-ONEPLUS A3010-136-XXXXXXXXXXXXX APP/xiaomi.smarthome APPV/62830"
+	sdkVersion = "accountsdk-18.8.15"
+	jsonPrefix = "&&&START&&&"
+)
+
+var (
+	Regions = []string{"cn", "de", "us", "ru", "tw", "sg", "in", "i2"}
+
+	ErrRegion      = errors.New("unknown region")
+	ErrLogin       = errors.New("login failed")
+	ErrTwoFactor   = errors.New("login needs confirmation (2fa or captcha), confirm it in browser and try again")
+	ErrNotLoggedIn = errors.New("not logged in")
+)
+
+type Device struct {
+	Did     string `json:"did"`
+	Token   string `json:"token"`
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+	Mac     string `json:"mac"`
+	LocalIp string `json:"localip"`
+	Online  bool   `json:"isOnline"`
+}
+
+type Client struct {
+	AccountURL string
+	APIURL     string
+	Region     string
+
+	http         *http.Client
+	deviceId     string
+	userId       string
+	ssecurity    string
+	serviceToken string
+}
+
+// CheckRegion return ErrRegion if region is not known
+func CheckRegion(region string) error {
+	for _, r := range Regions {
+		if r == region {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q, use one of %s", ErrRegion, region, strings.Join(Regions, ","))
+}
+
+// NewClient create client for region, region can be changed after login, session is valid for all of them
+func NewClient(region string) (*Client, error) {
+	if err := CheckRegion(region); err != nil {
+		return nil, err
+	}
+
+	jar, _ := cookiejar.New(nil)
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &Client{
+		AccountURL: DefaultAccountURL,
+		APIURL:     DefaultAPIURL,
+		Region:     region,
+		http:       &http.Client{Jar: jar, Timeout: time.Second * 15},
+		deviceId:   strings.ToUpper(hex.EncodeToString(id)),
+	}, nil
+}
+
+// Login get ssecurity and serviceToken used to sign api requests
+func (c *Client) Login(user string, password string) error {
+	account, err := url.Parse(c.AccountURL)
+	if err != nil {
+		return err
+	}
+	c.http.Jar.SetCookies(account, []*http.Cookie{
+		{Name: "sdkVersion", Value: sdkVersion},
+		{Name: "deviceId", Value: c.deviceId},
+	})
+
+	// step 1: sign
+	var step1 struct {
+		Sign string `json:"_sign"`
+	}
+	if err := c.account("GET", "/pass/serviceLogin?sid=xiaomiio&_json=true", nil, &step1); err != nil {
+		return err
+	}
+
+	// step 2: credentials
+	hash := md5.Sum([]byte(password))
+	form := url.Values{
+		"sid":      {"xiaomiio"},
+		"hash":     {strings.ToUpper(hex.EncodeToString(hash[:]))},
+		"callback": {"https://sts.api.io.mi.com/sts"},
+		"qs":       {"%3Fsid%3Dxiaomiio%26_json%3Dtrue"},
+		"user":     {user},
+		"_sign":    {step1.Sign},
+		"_json":    {"true"},
+	}
+	var step2 struct {
+		Code            int         `json:"code"`
+		Desc            string      `json:"desc"`
+		Ssecurity       string      `json:"ssecurity"`
+		UserId          json.Number `json:"userId"`
+		Location        string      `json:"location"`
+		NotificationUrl string      `json:"notificationUrl"`
+		CaptchaUrl      string      `json:"captchaUrl"`
+	}
+	if err := c.account("POST", "/pass/serviceLoginAuth2", form, &step2); err != nil {
+		return err
+	}
+	if step2.NotificationUrl != "" || step2.CaptchaUrl != "" {
+		return ErrTwoFactor
+	}
+	if step2.Code != 0 || step2.Ssecurity == "" || step2.Location == "" {
+		return fmt.Errorf("%w: code %d %s", ErrLogin, step2.Code, step2.Desc)
+	}
+
+	// step 3: service token
+	resp, err := c.http.Get(step2.Location)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	token := ""
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "serviceToken" {
+			token = cookie.Value
+		}
+	}
+	if location, err := url.Parse(step2.Location); token == "" && err == nil {
+		for _, cookie := range c.http.Jar.Cookies(location) {
+			if cookie.Name == "serviceToken" {
+				token = cookie.Value
+			}
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("%w: no service token", ErrLogin)
+	}
+
+	c.userId = step2.UserId.String()
+	c.ssecurity = step2.Ssecurity
+	c.serviceToken = token
+	return nil
+}
+
+// account call account api, answer starts with &&&START&&& before json
+func (c *Client) account(method string, path string, form url.Values, v interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, c.AccountURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s %s", ErrLogin, path, resp.Status)
+	}
+
+	return json.Unmarshal(bytes.TrimPrefix(buf, []byte(jsonPrefix)), v)
+}
+
+// Devices return devices of all homes in region
+func (c *Client) Devices() ([]Device, error) {
+	var res struct {
+		List []Device `json:"list"`
+	}
+	err := c.Call("/home/device_list", map[string]interface{}{
+		"getVirtualModel":    true,
+		"getHuamiDevices":    1,
+		"get_split_device":   false,
+		"support_smart_home": true,
+	}, &res)
+	return res.List, err
+}
+
+// Call send rc4 encrypted request to api path (e.g. /home/device_list) and decode result
+func (c *Client) Call(path string, data interface{}, v interface{}) error {
+	if c.ssecurity == "" {
+		return ErrNotLoggedIn
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	nonce := generateNonce(time.Now())
+	signed, err := signNonce(c.ssecurity, nonce)
+	if err != nil {
+		return err
+	}
+
+	// order of params is important for signature
+	params := []param{{"data", string(payload)}}
+	params = append(params, param{"rc4_hash__", signature("POST", path, signed, params)})
+	for i := range params {
+		if params[i].value, err = rc4Encrypt(signed, []byte(params[i].value)); err != nil {
+			return err
+		}
+	}
+	params = append(params,
+		param{"signature", signature("POST", path, signed, params)},
+		param{"ssecurity", c.ssecurity},
+		param{"_nonce", nonce})
+
+	form := url.Values{}
+	for _, p := range params {
+		form.Set(p.key, p.value)
+	}
+
+	api := strings.ReplaceAll(c.APIURL, "{region}", c.regionPrefix())
+	req, err := http.NewRequest("POST", api+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("x-xiaomi-protocal-flag-cli", "PROTOCAL-HTTP2")
+	req.Header.Set("MIOT-ENCRYPT-ALGORITHM", "ENCRYPT-RC4")
+	for _, cookie := range []*http.Cookie{
+		{Name: "userId", Value: c.userId},
+		{Name: "yetAnotherServiceToken", Value: c.serviceToken},
+		{Name: "serviceToken", Value: c.serviceToken},
+		{Name: "locale", Value: "en_GB"},
+		{Name: "channel", Value: "MI_APP_STORE"},
+	} {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cloud %s: %s", path, resp.Status)
+	}
+
+	plain, err := rc4Decrypt(signed, string(buf))
+	if err != nil {
+		return fmt.Errorf("cloud %s: can't decrypt answer: %w", path, err)
+	}
+
+	var answer struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(plain, &answer); err != nil {
+		return fmt.Errorf("cloud %s: %w", path, err)
+	}
+	if answer.Code != 0 {
+		return fmt.Errorf("cloud %s: code %d %s", path, answer.Code, answer.Message)
+	}
+
+	return json.Unmarshal(answer.Result, v)
+}
+
+func (c *Client) regionPrefix() string {
+	if c.Region == "cn" {
+		return ""
+	}
+	return c.Region + "."
+}
+
+type param struct {
+	key   string
+	value string
+}
+
+// generateNonce return base64 of 8 random bytes and minutes since epoch
+func generateNonce(now time.Time) string {
+	buf := make([]byte, 12)
+	rand.Read(buf[:8])
+	binary.BigEndian.PutUint32(buf[8:], uint32(now.Unix()/60))
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// signNonce return base64 sha256 of ssecurity and nonce
+func signNonce(ssecurity string, nonce string) (string, error) {
+	s, err := base64.StdEncoding.DecodeString(ssecurity)
+	if err != nil {
+		return "", fmt.Errorf("wrong ssecurity: %w", err)
+	}
+	n, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(s)
+	hash.Write(n)
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// signature return base64 sha1 of "METHOD&path&k=v...&signedNonce"
+func signature(method string, path string, signedNonce string, params []param) string {
+	parts := []string{strings.ToUpper(method), path}
+	for _, p := range params {
+		parts = append(parts, p.key+"="+p.value)
+	}
+	parts = append(parts, signedNonce)
+	hash := sha1.Sum([]byte(strings.Join(parts, "&")))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// rc4Cipher return rc4 keyed with signed nonce, first 1024 bytes of key stream are dropped
+func rc4Cipher(signedNonce string) (*rc4.Cipher, error) {
+	key, err := base64.StdEncoding.DecodeString(signedNonce)
+	if err != nil {
+		return nil, err
+	}
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	drop := make([]byte, 1024)
+	c.XORKeyStream(drop, drop)
+	return c, nil
+}
+
+func rc4Encrypt(signedNonce string, data []byte) (string, error) {
+	c, err := rc4Cipher(signedNonce)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(data))
+	c.XORKeyStream(buf, data)
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func rc4Decrypt(signedNonce string, data string) ([]byte, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, err
+	}
+	c, err := rc4Cipher(signedNonce)
+	if err != nil {
+		return nil, err
+	}
+	c.XORKeyStream(buf, buf)
+	return buf, nil
+}
@@ -0,0 +1,131 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// known values computed with python-miio algorithm
+func TestSignature(t *testing.T) {
+	ssecurity := base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+	nonce := base64.StdEncoding.EncodeToString([]byte{100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111})
+
+	signed, err := signNonce(ssecurity, nonce)
+	if err != nil || signed != "+JfC+ScjV+jXa9PgCRtBpAfTWAAwPFTV0LabBt47GcA=" {
+		t.Fatalf("signed nonce %s %v", signed, err)
+	}
+
+	params := []param{{"data", `{"a":1}`}}
+	params = append(params, param{"rc4_hash__", signature("POST", "/home/device_list", signed, params)})
+	if params[1].value != "huH0tYhGW5QatMxMkUmF49q/YkM=" {
+		t.Fatalf("rc4 hash %s", params[1].value)
+	}
+
+	for i := range params {
+		params[i].value, _ = rc4Encrypt(signed, []byte(params[i].value))
+	}
+	if params[0].value != "cBCM9dyWiA==" || params[1].value != "Y0el55L+nQJgFAI3RZgCcLfb+89GDCPkCBmreg==" {
+		t.Fatalf("encrypted params %v", params)
+	}
+	if s := signature("POST", "/home/device_list", signed, params); s != "LGMRnT58MFpK642kz7REcShqInA=" {
+		t.Fatalf("signature %s", s)
+	}
+}
+
+// standIn is local http server answering as xiaomi account and api servers
+func standIn(t *testing.T, password string) *httptest.Server {
+	ssecurity := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	hash := md5.Sum([]byte(password))
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pass/serviceLogin", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("sdkVersion"); err != nil || c.Value == "" {
+			t.Error("no sdkVersion cookie")
+		}
+		fmt.Fprint(w, `&&&START&&&{"_sign":"sign123","code":70016}`)
+	})
+	mux.HandleFunc("/pass/serviceLoginAuth2", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("_sign") != "sign123" || r.Form.Get("hash") != strings.ToUpper(hex.EncodeToString(hash[:])) {
+			fmt.Fprint(w, `&&&START&&&{"code":70016,"desc":"wrong password"}`)
+			return
+		}
+		fmt.Fprintf(w, `&&&START&&&{"code":0,"ssecurity":%q,"userId":42,"location":"%s/sts?d=1"}`, ssecurity, srv.URL)
+	})
+	mux.HandleFunc("/sts", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "serviceToken", Value: "service-token"})
+	})
+	mux.HandleFunc("/de.app/home/device_list", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if c, err := r.Cookie("serviceToken"); err != nil || c.Value != "service-token" {
+			t.Error("no service token")
+		}
+		if r.Form.Get("ssecurity") != ssecurity {
+			t.Error("wrong ssecurity")
+		}
+		signed, _ := signNonce(ssecurity, r.Form.Get("_nonce"))
+		params := []param{{"data", r.Form.Get("data")}, {"rc4_hash__", r.Form.Get("rc4_hash__")}}
+		if signature("POST", "/home/device_list", signed, params) != r.Form.Get("signature") {
+			t.Error("wrong signature")
+		}
+		data, err := rc4Decrypt(signed, r.Form.Get("data"))
+		if err != nil || !strings.Contains(string(data), `"getVirtualModel":true`) {
+			t.Errorf("wrong data %s %v", data, err)
+		}
+
+		answer, _ := rc4Encrypt(signed, []byte(`{"code":0,"message":"ok","result":{"list":[`+
+			`{"did":"305419896","token":"00112233445566778899aabbccddeeff","name":"desk","model":"yeelink.light.mono1",`+
+			`"mac":"AA:BB:CC:DD:EE:FF","localip":"10.0.0.5","isOnline":true}]}}`))
+		fmt.Fprint(w, answer)
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func client(t *testing.T, srv *httptest.Server) *Client {
+	c, err := NewClient("de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AccountURL = srv.URL
+	c.APIURL = srv.URL + "/{region}app"
+	return c
+}
+
+func TestDevices(t *testing.T) {
+	c := client(t, standIn(t, "secret"))
+	if err := c.Login("user@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := c.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Token != "00112233445566778899aabbccddeeff" || devices[0].LocalIp != "10.0.0.5" {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	c := client(t, standIn(t, "secret"))
+	if err := c.Login("user@example.com", "wrong"); !errors.Is(err, ErrLogin) {
+		t.Fatalf("expected ErrLogin, got %v", err)
+	}
+	if _, err := c.Devices(); !errors.Is(err, ErrNotLoggedIn) {
+		t.Fatalf("expected ErrNotLoggedIn, got %v", err)
+	}
+	if _, err := NewClient("xx"); !errors.Is(err, ErrRegion) {
+		t.Fatalf("expected ErrRegion, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Package config read manager settings from json file:
+
+	{
+	  "mqtt": {"server": "127.0.0.1:1883", "clientid": "xiaomi-1", "keepalive": 30, "qos": 0},
+	  "discovery": {"targets": ["224.0.0.251", "10.20.0.0/22"], "broadcast": true, "rate": 50, "interval": "10s"},
+	  "log": {"debug": false, "file": ""},
+	  "registry": "devices.json",
+	  "poll": "30s",
+	  "devices": [
+	    {"id": "1a2b3c4d", "name": "desk lamp", "room": "office", "poll": "5s", "props": ["power", "bright"]}
+	  ]
+	}
+
+Flags and environment variables override file values, see main.
+*/
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"manager_xiaomi/discovery"
+	"manager_xiaomi/manager"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/registry"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is time.Duration written as "30s" in config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"30s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Mqtt struct {
+	Server    string `json:"server"`
+	ClientId  string `json:"clientid"`
+	KeepAlive int    `json:"keepalive"`
+	Login     string `json:"login,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	Qos       int    `json:"qos"`
+}
+
+type Discovery struct {
+	Listen    string   `json:"listen,omitempty"`
+	Targets   []string `json:"targets,omitempty"` // addresses and networks to sweep
+	Multicast bool     `json:"multicast"`         // send hello to 224.0.0.251 as well, true by default
+	Broadcast bool     `json:"broadcast"`
+	Rate      int      `json:"rate"` // sweep packets per second
+	Interval  Duration `json:"interval"`
+	Sweep     Duration `json:"sweep"` // pause between sweeps
+	Mdns      bool     `json:"mdns"`  // browse _miio._udp.local services
+}
+
+type Log struct {
+	Debug bool   `json:"debug"`
+	File  string `json:"file,omitempty"` // stderr if empty
+}
+
+type Device struct {
+	Id    string   `json:"id"`
+	Name  string   `json:"name,omitempty"`
+	Room  string   `json:"room,omitempty"`
+	Poll  Duration `json:"poll,omitempty"`
+	Props []string `json:"props,omitempty"`
+}
+
+type Config struct {
+	Mqtt      Mqtt      `json:"mqtt"`
+	Discovery Discovery `json:"discovery"`
+	Log       Log       `json:"log"`
+	Registry  string    `json:"registry"`
+	Specs     string    `json:"specs"`
+	SpecURL   string    `json:"spec_url"`
+	Hass      string    `json:"hass"`
+	Misses    int       `json:"misses"`
+	Reconnect Duration  `json:"reconnect"`
+	QueueWait Duration  `json:"queue_wait"`
+	Poll      Duration  `json:"poll"`
+	Devices   []Device  `json:"devices,omitempty"`
+}
+
+// Default return config used without file
+func Default() *Config {
+	return &Config{
+		Mqtt:      Mqtt{Server: "127.0.0.1:1883", ClientId: "xiaomi-1", KeepAlive: 30},
+		Discovery: Discovery{Multicast: true, Rate: discovery.Rate, Interval: Duration{discovery.Interval}, Sweep: Duration{discovery.Sweep}},
+		Registry:  "devices.json",
+		Specs:     "specs",
+		SpecURL:   miio.DefaultSpecURL,
+		Hass:      "homeassistant",
+		Misses:    3,
+		Reconnect: Duration{time.Minute},
+		Poll:      Duration{time.Second * 30},
+	}
+}
+
+// Load read config file over defaults. Unknown fields are reported as errors to catch typos.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			return nil, fmt.Errorf("%s: syntax error at offset %d: %w", path, syntax.Offset, err)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// Validate check all values and return error listing every problem found
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Mqtt.Server); err != nil {
+		add("mqtt.server %q should be host:port", c.Mqtt.Server)
+	}
+	if c.Mqtt.ClientId == "" {
+		add("mqtt.clientid is empty")
+	}
+	if c.Mqtt.KeepAlive < 1 || c.Mqtt.KeepAlive > 0xffff {
+		add("mqtt.keepalive %d should be 1..65535 seconds", c.Mqtt.KeepAlive)
+	}
+	if c.Mqtt.Qos < 0 || c.Mqtt.Qos > 2 {
+		add("mqtt.qos %d should be 0, 1 or 2", c.Mqtt.Qos)
+	}
+
+	if c.Discovery.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Discovery.Listen); err != nil {
+			add("discovery.listen %q should be host:port", c.Discovery.Listen)
+		}
+	}
+	for _, t := range c.Discovery.Targets {
+		if _, _, err := discovery.ParseTarget(t); err != nil {
+			add("discovery.targets: %s", err)
+		}
+	}
+	if c.Discovery.Rate < 1 {
+		add("discovery.rate %d should be at least 1 packet per second", c.Discovery.Rate)
+	}
+	if c.Discovery.Interval.Duration <= 0 {
+		add("discovery.interval should be positive")
+	}
+	if c.Discovery.Sweep.Duration <= 0 {
+		add("discovery.sweep should be positive")
+	}
+
+	if c.Registry == "" {
+		add("registry is empty")
+	}
+	if c.Misses < 1 {
+		add("misses %d should be at least 1", c.Misses)
+	}
+	if c.Reconnect.Duration <= 0 {
+		add("reconnect should be positive")
+	}
+	if c.QueueWait.Duration < 0 {
+		add("queue_wait should not be negative")
+	}
+	if c.Poll.Duration < 0 {
+		add("poll should not be negative")
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range c.Devices {
+		id := strings.ToLower(d.Id)
+		if _, err := strconv.ParseUint(id, 16, 32); err != nil {
+			add("devices[%d]: id %q should be hex device id", i, d.Id)
+		} else if seen[id] {
+			add("devices[%d]: id %s is listed twice", i, d.Id)
+		}
+		seen[id] = true
+		if d.Poll.Duration < 0 {
+			add("devices[%d]: poll should not be negative", i)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Manager return settings for manager.Run
+func (c *Config) Manager() manager.Config {
+	mc := manager.Config{
+		Debug:     c.Log.Debug,
+		Mqtt:      c.Mqtt.Server,
+		ClientId:  c.Mqtt.ClientId,
+		KeepAlive: c.Mqtt.KeepAlive,
+		Login:     c.Mqtt.Login,
+		Pass:      c.Mqtt.Pass,
+		Qos:       c.Mqtt.Qos,
+		Registry:  c.Registry,
+		Hass:      c.Hass,
+		Misses:    c.Misses,
+		Poll:      c.Poll.Duration,
+		Reconnect: c.Reconnect.Duration,
+		QueueWait: c.QueueWait.Duration,
+		Discovery: discovery.Config{
+			Listen:      c.Discovery.Listen,
+			Targets:     c.Discovery.Targets,
+			NoMulticast: !c.Discovery.Multicast,
+			Broadcast:   c.Discovery.Broadcast,
+			Rate:        c.Discovery.Rate,
+			Interval:    c.Discovery.Interval.Duration,
+			Sweep:       c.Discovery.Sweep.Duration,
+			Mdns:        c.Discovery.Mdns,
+		},
+		Devices: make(map[string]manager.DeviceConfig),
+	}
+
+	for _, d := range c.Devices {
+		mc.Devices[registry.NormalizeId(d.Id)] = manager.DeviceConfig{
+			Name:  d.Name,
+			Room:  d.Room,
+			Poll:  d.Poll.Duration,
+			Props: d.Props,
+		}
+	}
+
+	return mc
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(write(t, `{
+		"mqtt": {"server": "10.0.0.1:1883"},
+		"poll": "10s",
+		"discovery": {"mdns": true},
+		"devices": [{"id": "01A2", "name": "desk", "room": "office", "poll": "5s", "props": ["power"]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unset values keep defaults
+	if c.Mqtt.ClientId != "xiaomi-1" || c.Misses != 3 {
+		t.Fatalf("defaults lost: %+v", c)
+	}
+
+	m := c.Manager()
+	if m.Mqtt != "10.0.0.1:1883" || m.Poll != time.Second*10 || !m.Discovery.Mdns || m.Discovery.NoMulticast {
+		t.Fatalf("unexpected manager config %+v", m)
+	}
+	d, ok := m.Devices["1a2"]
+	if !ok || d.Name != "desk" || d.Room != "office" || d.Poll != time.Second*5 || len(d.Props) != 1 {
+		t.Fatalf("unexpected device config %+v", m.Devices)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for data, msg := range map[string]string{
+		`{"mqtt": {"srv": "x"}}`: `unknown field "srv"`,
+		`{"poll": 30}`:           "duration should be a string",
+		`{"poll": "30"}`:         "missing unit",
+		`{"mqtt": {`:             "unexpected EOF",
+	} {
+		if _, err := Load(write(t, data)); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: error %v, expected %q", data, err, msg)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Mqtt.Server = "localhost"
+	c.Mqtt.Qos = 3
+	c.Discovery.Targets = []string{"10.0.0.300", "10.0.0.0/24"}
+	c.Devices = []Device{{Id: "zz"}, {Id: "1a"}, {Id: "1A"}}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, msg := range []string{"mqtt.server", "mqtt.qos", "discovery.targets", "devices[0]",
+		"devices[2]: id 1A is listed twice"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("%q not reported: %s", msg, err)
+		}
+	}
+
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -27,15 +27,19 @@ func NewBulb(debug bool, model string, id string, ip string, token []byte) *Bulb
 			Ip:          ip,
 			Token:       token,
 			debug:       debug,
-			request:     1,
+			requestId:   1,
+			props:       []string{"power", "bright"},
 		},
 	}
 	return bulb
 }
 
 func (b *Bulb) String() string {
+	retain := b.MiIoDevice.Retain()
+	b.state.Lock()
+	defer b.state.Unlock()
 	return fmt.Sprintf(`{%s,"ip":"%s","timestamp":%d}`,
-		b.MiIoDevice.Retain(), b.Ip, b.Timestamp)
+		retain, b.Ip, b.Timestamp)
 }
 
 func (b *Bulb) Retain() string {
@@ -1,7 +1,10 @@
 package device
 
 import (
+	"context"
 	"encoding/hex"
+	"log"
+	"manager_xiaomi/miio"
 )
 
 const (
@@ -9,6 +12,7 @@ const (
 	BULB
 	RGB_BULB
 	REPEATER
+	MIOT
 )
 
 type Type byte
@@ -21,6 +25,8 @@ func (t Type) String() string {
 		return "RGB bulb"
 	case REPEATER:
 		return "WiFi repeater"
+	case MIOT:
+		return "MIoT device"
 	default:
 		return "n/a"
 	}
@@ -32,7 +38,12 @@ type Device interface {
 	ID() uint32
 	IP() string
 	Connect(ip string) error
+	Connected() bool
 	Close() error
+	Send(method string, params interface{}) (*miio.Response, error)
+	Set(prop string, value interface{}) (*miio.Response, error)
+	Call(ctx context.Context, method string, params interface{}) (*miio.Response, error)
+	State() (map[string]interface{}, error)
 	String() string
 	Retain() string
 }
@@ -71,17 +82,41 @@ func CheckDevice(model string) Type {
 	}
 }
 
+// specs used to create generic miot devices for models without own type
+var specs *miio.SpecStore
+
+// UseSpecs set spec store for CreateDevice
+func UseSpecs(store *miio.SpecStore) {
+	specs = store
+}
+
 /* return nil if device doen't known
  */
-func CreateDevice(debug bool, model string, id string, ip string, tokenStr string) Device {
+func CreateDevice(debug bool, model string, id string, name string, ip string, tokenStr string) Device {
 	var dev Device
 	token, _ := hex.DecodeString(tokenStr)
 
 	switch CheckDevice(model) {
 	case BULB:
-		dev = NewBulb(debug, model, id, ip, token)
+		bulb := NewBulb(debug, model, id, ip, token)
+		bulb.Name = name
+		dev = bulb
 	case REPEATER:
-		dev = NewRepeater(debug, model, id, ip, token)
+		repeater := NewRepeater(debug, model, id, ip, token)
+		repeater.Name = name
+		dev = repeater
+	default:
+		if specs == nil {
+			break
+		}
+		spec, err := specs.ModelDetail(model)
+		if err != nil {
+			log.Println("no miot spec for", model, err)
+			break
+		}
+		miot := NewMiotDevice(debug, model, id, ip, token, spec)
+		miot.Name = name
+		dev = miot
 	}
 
 	return dev
@@ -0,0 +1,99 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"manager_xiaomi/miio"
+	"sync"
+)
+
+const (
+	// devices accept request ids up to 9999, counter wraps to 1 after it
+	maxRequestId = 9999
+	// ids reserved in store by blocks, so store isn't written on every request
+	reserveIds = 100
+	// id step after device reported duplicate id
+	duplicateStep = 100
+	// how many times request is repeated with the new id
+	duplicateRetries = 2
+	// "user ack timeout" answered by device for duplicated or too old id
+	codeDuplicateId = -9999
+)
+
+// IdStore keep request id counters of devices between restarts
+type IdStore interface {
+	// LoadRequestId return last reserved id or 0
+	LoadRequestId(deviceId uint32) int
+	// ReserveRequestId remember that ids up to upto can be used
+	ReserveRequestId(deviceId uint32, upto int)
+}
+
+var (
+	ids     IdStore
+	idsLock sync.RWMutex
+)
+
+// UseIdStore set store for device request id counters, store can be replaced while devices work
+func UseIdStore(store IdStore) {
+	idsLock.Lock()
+	defer idsLock.Unlock()
+	ids = store
+}
+
+func idStore() IdStore {
+	idsLock.RLock()
+	defer idsLock.RUnlock()
+	return ids
+}
+
+// RequestError is a communication error for request sent with id
+type RequestError struct {
+	Id  int
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request %d: %s", e.Id, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// nextId return next request id. Called with x.lock held.
+func (x *MiIoDevice) nextId() int {
+	ids := idStore()
+	if x.reservedId == 0 && ids != nil {
+		// continue after ids used before restart
+		x.reservedId = ids.LoadRequestId(x.Id)
+		if x.reservedId > x.requestId {
+			x.requestId = x.reservedId
+		}
+	}
+
+	x.requestId++
+	if x.requestId > maxRequestId || x.requestId < 1 {
+		x.requestId = 1
+		x.reservedId = 0
+	}
+
+	if x.requestId >= x.reservedId {
+		x.reservedId = x.requestId + reserveIds
+		if ids != nil {
+			ids.ReserveRequestId(x.Id, x.reservedId)
+		}
+	}
+
+	return x.requestId
+}
+
+// skipIds move counter forward after device reported duplicate id
+func (x *MiIoDevice) skipIds() {
+	x.requestId += duplicateStep - 1
+}
+
+// duplicateId check error answered by device for already used request id
+func duplicateId(err error) bool {
+	var re *miio.ResponseError
+	return errors.As(err, &re) && re.Code == codeDuplicateId
+}
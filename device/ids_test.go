@@ -0,0 +1,132 @@
+package device
+
+import (
+	"encoding/json"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/miio/sim"
+	"testing"
+)
+
+// memIds is IdStore kept in memory
+type memIds map[uint32]int
+
+func (m memIds) LoadRequestId(deviceId uint32) int {
+	return m[deviceId]
+}
+
+func (m memIds) ReserveRequestId(deviceId uint32, upto int) {
+	m[deviceId] = upto
+}
+
+func useIds(t *testing.T, store IdStore) {
+	UseIdStore(store)
+	t.Cleanup(func() { UseIdStore(nil) })
+}
+
+func TestReserveIds(t *testing.T) {
+	store := memIds{}
+	useIds(t, store)
+
+	dev := NewMiIoDevice(false, 0x30002, "")
+	if id := dev.nextId(); id != 2 || store[0x30002] != 2+reserveIds {
+		t.Fatalf("first id %d, reserved %d", id, store[0x30002])
+	}
+	// store is written once per block of ids
+	for i := 0; i < reserveIds; i++ {
+		dev.nextId()
+	}
+	if dev.requestId != 2+reserveIds || store[0x30002] != 2+2*reserveIds {
+		t.Fatalf("id %d, reserved %d", dev.requestId, store[0x30002])
+	}
+
+	// after restart ids continue after reserved block, ids given before restart are not repeated
+	dev = NewMiIoDevice(false, 0x30002, "")
+	if id := dev.nextId(); id != 2+2*reserveIds+1 {
+		t.Fatalf("id after restart %d", id)
+	}
+}
+
+func TestWrapIds(t *testing.T) {
+	store := memIds{0x30003: maxRequestId - 2}
+	useIds(t, store)
+
+	dev := NewMiIoDevice(false, 0x30003, "")
+	var got []int
+	for i := 0; i < 4; i++ {
+		got = append(got, dev.nextId())
+	}
+	if got[0] != maxRequestId-1 || got[1] != maxRequestId || got[2] != 1 || got[3] != 2 {
+		t.Fatalf("unexpected ids %v", got)
+	}
+	// new block is reserved from the start after wrap
+	if store[0x30003] != 1+reserveIds {
+		t.Fatalf("reserved %d after wrap", store[0x30003])
+	}
+}
+
+func TestDuplicateId(t *testing.T) {
+	useIds(t, memIds{})
+	s := startSim(t, sim.Config{Id: 0x30004, Token: testToken, Addr: "127.0.0.42:54321"})
+	answers := 0
+	s.Handle("get_prop", func(method string, params json.RawMessage) (interface{}, *miio.ResponseError) {
+		if answers++; answers == 1 {
+			return nil, &miio.ResponseError{Code: codeDuplicateId, Message: "user ack timeout"}
+		}
+		return []interface{}{"on"}, nil
+	})
+
+	dev := NewMiIoDevice(false, 0x30004, "")
+	dev.Token = testToken
+	defer dev.Close()
+	if err := dev.Connect("127.0.0.42"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := dev.Send("get_prop", []string{"power"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// request repeated once with id moved forward by duplicateStep
+	reqs := s.Requests()
+	if len(reqs) != 2 || reqs[1].Id != reqs[0].Id+duplicateStep || resp.Id != reqs[1].Id {
+		t.Fatalf("unexpected requests %+v, answer id %d", reqs, resp.Id)
+	}
+
+	// device rejecting every id gives error after retries
+	s.Handle("get_prop", func(method string, params json.RawMessage) (interface{}, *miio.ResponseError) {
+		return nil, &miio.ResponseError{Code: codeDuplicateId, Message: "user ack timeout"}
+	})
+	if _, err := dev.Send("get_prop", []string{"power"}); !duplicateId(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := len(s.Requests()); n != 2+duplicateRetries+1 {
+		t.Fatalf("%d requests sent", n)
+	}
+}
+
+func TestReplaceIdStore(t *testing.T) {
+	useIds(t, memIds{})
+	s := startSim(t, sim.Config{Id: 0x30008, Token: testToken, Addr: "127.0.0.46:54321", Props: map[string]interface{}{"power": "on"}})
+	dev := NewMiIoDevice(false, 0x30008, "")
+	dev.Token = testToken
+	defer dev.Close()
+	if err := dev.Connect(s.Addr().IP.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// registry reload replaces store while device sends requests
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			UseIdStore(memIds{})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		dev.reservedId = 0 // force store read
+		if _, err := dev.Send("get_prop", []string{"power"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
@@ -1,14 +1,15 @@
 package device
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"manager_xiaomi/miio"
-	"manager_xiaomi/utils"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,32 +17,43 @@ var (
 	timeout             = time.Second * 3
 	devicePort          = 54321
 	ErrAlreadyConnected = errors.New("already connected")
+	ErrNotConnected     = errors.New("not connected")
 )
 
 type MiIoDevice struct {
-	deviceModel string   `json:"model"`
-	deviceType  Type     `json:"type"`
-	Name        string   `json:"name"`
-	Token       []byte   `json:"token"`
-	VmPeak      int      `json:"VmPeak"`
-	VmSize      int      `json:"VmSize"`
-	VmFree      int      `json:"VmFree"`
-	VmRSS       int      `json:"VmRSS"`
-	MemFree     int      `json:"MemFree"`
-	Ip          string   `json:"-"`
-	Id          uint32   `json:"-"`
-	Timestamp   uint32   `json:"-"`
-	request     int      `json:"-"`
+	deviceModel string
+	deviceType  Type
+	Name        string `json:"name"`
+	Token       []byte `json:"token"`
+	VmPeak      int    `json:"VmPeak"`
+	VmSize      int    `json:"VmSize"`
+	VmFree      int    `json:"VmFree"`
+	VmRSS       int    `json:"VmRSS"`
+	MemFree     int    `json:"MemFree"`
+	Ip          string `json:"-"`
+	Id          uint32 `json:"-"`
+	Timestamp   uint32 `json:"-"`
+	requestId   int    `json:"-"`
+	reservedId  int
 	conn        net.Conn `json:"-"`
 	debug       bool     `json:"-"`
+	props       []string
+	lock        sync.Mutex    // held for whole exchange with device
+	state       sync.Mutex    // guard queue, ready, Ip, Timestamp and registration, never held for i/o
+	ready       chan struct{} // not nil while session is restored by supervisor
+	timeouts    int           // requests not answered in a row, session is dropped after lostTimeouts
+	alive       int32         // 1 while session is open, read without lock
+	closed      bool
+	calls       chan *call // request queue served by device goroutine
+	quit        chan struct{}
 }
 
 func NewMiIoDevice(debug bool, id uint32, ip string) *MiIoDevice {
 	return &MiIoDevice{
-		debug:   debug,
-		Id:      id,
-		Ip:      ip,
-		request: 1,
+		debug:     debug,
+		Id:        id,
+		Ip:        ip,
+		requestId: 1,
 	}
 }
 
@@ -53,33 +65,42 @@ func (x *MiIoDevice) Model() string {
 	return x.deviceModel
 }
 
+// SetModel keep model reported by discovery, device is not asked for it
+func (x *MiIoDevice) SetModel(model string) {
+	x.deviceModel = model
+}
+
 func (x *MiIoDevice) ID() uint32 {
 	return x.Id
 }
 
 func (x *MiIoDevice) IP() string {
+	x.state.Lock()
+	defer x.state.Unlock()
 	return x.Ip
 }
 
 func (x *MiIoDevice) Connect(ip string) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
 	if x.Timestamp > 0 {
 		return ErrAlreadyConnected
 	}
 
-	if ip != "" {
-		x.Ip = ip
-		x.request = 1
-	}
-
-	var err error
-	if x.conn, err = net.DialTimeout("udp4", fmt.Sprintf("%s:%d", x.Ip, devicePort), timeout); err != nil {
-		return err
+	if ip == "" {
+		ip = x.Ip
 	}
+	x.closed = false
 
-	hello, err := x.Hello()
+	hello, err := x.handshake(ip)
 	if err != nil {
 		return err
 	}
+	// address is kept for working session only, device is connected again when discovery finds it next time
+	x.state.Lock()
+	defer x.state.Unlock()
+	x.Ip = ip
 
 	log.Println("mii connect hello", hello.String())
 
@@ -94,18 +115,94 @@ func (x *MiIoDevice) Connect(ip string) error {
 	return nil
 }
 
+// Probe open session to ip with token and ask miIO.info once. Probe has no queue and no supervisor, session
+// is closed when Probe returns whatever the answer is. Used to find out which token unknown device has.
+func Probe(debug bool, id uint32, ip string, token []byte) (*miio.Info, error) {
+	x := NewMiIoDevice(debug, id, ip)
+	x.Token = token
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	// closed device is never restored by supervisor
+	x.closed = true
+	defer x.disconnect()
+
+	if _, err := x.handshake(ip); err != nil {
+		return nil, err
+	}
+	resp, err := x.exchange(context.Background(), x.nextId(), "miIO.info", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info miio.Info
+	if err := resp.DecodeResult(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Close stop communication with device, session is not restored after Close
 func (x *MiIoDevice) Close() error {
+	x.stopQueue()
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.closed = true
+	return x.disconnect()
+}
+
+// Connected return true while device has working session, false before Connect and while session is restored
+func (x *MiIoDevice) Connected() bool {
+	return atomic.LoadInt32(&x.alive) == 1
+}
+
+func (x *MiIoDevice) disconnect() error {
+	atomic.StoreInt32(&x.alive, 0)
+	x.state.Lock()
 	x.Timestamp = 0
-	return x.conn.Close()
+	x.state.Unlock()
+	x.timeouts = 0
+	if x.conn == nil {
+		return nil
+	}
+	err := x.conn.Close()
+	x.conn = nil
+	return err
+}
+
+// handshake open new udp connection to ip and send hello to get device timestamp
+func (x *MiIoDevice) handshake(ip string) (*miio.Packet, error) {
+	x.disconnect()
+
+	var err error
+	if x.conn, err = net.DialTimeout("udp4", fmt.Sprintf("%s:%d", ip, devicePort), timeout); err != nil {
+		return nil, err
+	}
+
+	hello, err := x.Hello()
+	if err != nil {
+		x.disconnect()
+		return nil, err
+	}
+
+	atomic.StoreInt32(&x.alive, 1)
+	return hello, nil
 }
 
 func (x *MiIoDevice) String() string {
+	retain := x.Retain()
+	x.state.Lock()
+	defer x.state.Unlock()
 	return fmt.Sprintf(`{%s,"ip":"%s","timestamp":%d}`,
-		x.Retain(), x.Ip, x.Timestamp)
+		retain, x.Ip, x.Timestamp)
 }
 
 func (x *MiIoDevice) Retain() string {
-	return fmt.Sprintf(`"model":"%s","id":"%x","token":"%x"`, x.deviceModel, x.Id, x.Token)
+	x.state.Lock()
+	defer x.state.Unlock()
+	return fmt.Sprintf(`"model":"%s","id":"%x","name":"%s","token":"%x"`, x.deviceModel, x.Id, x.Name, x.Token)
 }
 
 // Hello method should be called before start any communication with device.
@@ -135,7 +232,9 @@ func (x *MiIoDevice) Hello() (*miio.Packet, error) {
 		return nil, err
 	}
 
+	x.state.Lock()
 	x.Timestamp = uint32(time.Now().Unix()) - pkt.Timestamp
+	x.state.Unlock()
 
 	return pkt, nil
 }
@@ -158,14 +257,42 @@ func (x *MiIoDevice) Prepare(deviceId uint32, deviceToken []byte, timestamp uint
 	return pkt.Pack()
 }
 
-// Send packet to prepared connection
-func (x *MiIoDevice) Send(method string, params interface{}) (*miio.Packet, error) {
+// Send request to device and return decoded response. Error answered by device returned
+// as *miio.ResponseError.
+func (x *MiIoDevice) Send(method string, params interface{}) (*miio.Response, error) {
+	return x.Call(context.Background(), method, params)
+}
+
+// request send one request and wait for the answer with the same id. Called by device queue only.
+func (x *MiIoDevice) request(ctx context.Context, method string, params interface{}) (*miio.Response, error) {
+	if err := x.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	for retry := 0; ; retry++ {
+		resp, err := x.exchange(ctx, x.nextId(), method, params)
+		if retry < duplicateRetries && duplicateId(err) {
+			log.Printf("device %x reject request id %d as duplicate, retry", x.Id, resp.Id)
+			x.skipIds()
+			continue
+		}
+		return resp, err
+	}
+}
+
+// exchange send request with id and wait for the answer. Called with x.lock held.
+func (x *MiIoDevice) exchange(ctx context.Context, id int, method string, params interface{}) (*miio.Response, error) {
 	req := miio.Request{
-		Id:     int(uint32(time.Now().Unix()) - x.Timestamp), //x.request,
+		Id:     id,
 		Method: method,
 		Params: params,
 	}
-	x.request++
 
 	payload, err := json.Marshal(req)
 	if err != nil {
@@ -181,62 +308,126 @@ func (x *MiIoDevice) Send(method string, params interface{}) (*miio.Packet, erro
 
 	// send request
 	if _, err := x.SendPacket(p); err != nil {
-		x.Close()
-		return nil, err
+		x.lost(err)
+		return nil, &RequestError{Id: id, Err: err}
 	}
 
-	// receive answer
-	recv, err := x.ReceivePacket()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// receive answer, datagrams left from previous (timed out) requests are dropped
+	for {
+		recv, err := x.receive(deadline)
+		if miio.IsFrameError(err) {
+			log.Printf("device %x drop packet: %s", x.Id, err)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, &RequestError{Id: id, Err: ctx.Err()}
+			}
+			// one lost answer fails only this request, device not answering several times is restored
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if x.timeouts++; x.timeouts < lostTimeouts {
+					return nil, &RequestError{Id: id, Err: err}
+				}
+			}
+			x.lost(err)
+			return nil, &RequestError{Id: id, Err: err}
+		}
+
+		pkt, err := miio.ParsePacket(x.Id, x.Token, recv)
+		if err != nil {
+			log.Printf("device %x drop packet: %s", x.Id, err)
+			continue
+		}
+
+		resp, err := miio.ParseResponse(pkt.Data)
+		if resp == nil {
+			log.Printf("device %x drop packet: %s", x.Id, err)
+			continue
+		}
+		if resp.Id != req.Id {
+			log.Printf("device %x drop stale answer id %d, wait for %d", x.Id, resp.Id, req.Id)
+			continue
+		}
+
+		log.Println("miio send response:", pkt.String())
+		x.timeouts = 0
+		return resp, err
+	}
+}
+
+// State read device properties with get_prop method
+func (x *MiIoDevice) State() (map[string]interface{}, error) {
+	state := make(map[string]interface{})
+	if len(x.props) == 0 {
+		return state, nil
+	}
+
+	resp, err := x.Send("get_prop", x.props)
 	if err != nil {
-		x.Close()
 		return nil, err
 	}
 
-	// parse received packet
-	pkt, err := miio.ParsePacket(x.Id, x.Token, recv)
-	if err != nil {
+	var values []interface{}
+	if err := resp.DecodeResult(&values); err != nil {
 		return nil, err
 	}
 
-	log.Println("miio send response:", pkt.String())
+	for i, v := range values {
+		if i < len(x.props) {
+			state[x.props[i]] = v
+		}
+	}
 
-	return pkt, nil
+	return state, nil
+}
+
+// Set change device property with set_<prop> method
+func (x *MiIoDevice) Set(prop string, value interface{}) (*miio.Response, error) {
+	if params, ok := value.([]interface{}); ok {
+		return x.Send("set_"+prop, params)
+	}
+	return x.Send("set_"+prop, []interface{}{value})
 }
 
 func (x *MiIoDevice) SendPacket(buf []byte) (int, error) {
+	if x.conn == nil {
+		return 0, ErrNotConnected
+	}
 	x.conn.SetWriteDeadline(time.Now().Add(timeout))
 	return x.conn.Write(buf)
 }
 
 func (x *MiIoDevice) ReceivePacket() ([]byte, error) {
-	var magic, size uint16
-	var err error
-
-	x.conn.SetReadDeadline(time.Now().Add(timeout))
-	reader := bufio.NewReader(x.conn)
+	return x.receive(time.Now().Add(timeout))
+}
 
-	header := make([]byte, 4)
-	if _, err := reader.Read(header); err != nil {
-		return nil, err
+// receive read one datagram. Whole packet is read at once into pooled buffer and copied to
+// right-sized slice after Length check.
+func (x *MiIoDevice) receive(deadline time.Time) ([]byte, error) {
+	if x.conn == nil {
+		return nil, ErrNotConnected
 	}
+	x.conn.SetReadDeadline(deadline)
 
-	if magic, _, err = utils.ReadInt16(header, 0); err != nil {
-		return nil, err
-	}
-	if magic != 0x2131 {
-		return nil, fmt.Errorf("wrong magic %d", magic)
-	}
+	bp := miio.GetBuffer()
+	defer miio.PutBuffer(bp)
+	buf := *bp
 
-	if size, _, err = utils.ReadInt16(header, 2); err != nil {
+	n, err := x.conn.Read(buf)
+	if err != nil {
 		return nil, err
 	}
 
-	res := make([]byte, size)
-	utils.WriteInt16(res, 0, magic)
-	utils.WriteInt16(res, 2, size)
-	if _, err = reader.Read(res[4:]); err != nil {
+	if err := miio.CheckFrame(buf[:n]); err != nil {
 		return nil, err
 	}
 
+	res := make([]byte, n)
+	copy(res, buf[:n])
 	return res, nil
 }
@@ -0,0 +1,112 @@
+package device
+
+import (
+	"fmt"
+	"manager_xiaomi/miio"
+)
+
+// devices do not accept too many properties in one request
+var maxProperties = 15
+
+func (x *MiIoDevice) did() string {
+	return fmt.Sprintf("%d", x.Id)
+}
+
+// GetProperties read miot properties. Result order is the same as requested, check Err() of every item.
+func (x *MiIoDevice) GetProperties(props []miio.PropRef) ([]miio.PropResult, error) {
+	var res []miio.PropResult
+
+	for start := 0; start < len(props); start += maxProperties {
+		end := start + maxProperties
+		if end > len(props) {
+			end = len(props)
+		}
+
+		req := make([]miio.PropRef, end-start)
+		copy(req, props[start:end])
+		for i := range req {
+			if req[i].Did == "" {
+				req[i].Did = x.did()
+			}
+		}
+
+		part, err := x.properties("get_properties", req, len(req))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, part...)
+	}
+
+	return res, nil
+}
+
+// SetProperties write miot properties. Result order is the same as requested, check Err() of every item.
+func (x *MiIoDevice) SetProperties(props []miio.PropValue) ([]miio.PropResult, error) {
+	var res []miio.PropResult
+
+	for start := 0; start < len(props); start += maxProperties {
+		end := start + maxProperties
+		if end > len(props) {
+			end = len(props)
+		}
+
+		req := make([]miio.PropValue, end-start)
+		copy(req, props[start:end])
+		for i := range req {
+			if req[i].Did == "" {
+				req[i].Did = x.did()
+			}
+		}
+
+		part, err := x.properties("set_properties", req, len(req))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, part...)
+	}
+
+	return res, nil
+}
+
+func (x *MiIoDevice) properties(method string, params interface{}, count int) ([]miio.PropResult, error) {
+	resp, err := x.Send(method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []miio.PropResult
+	if err := resp.DecodeResult(&res); err != nil {
+		return nil, err
+	}
+
+	if len(res) != count {
+		return nil, fmt.Errorf("%s: expect %d results, got %d", method, count, len(res))
+	}
+
+	return res, nil
+}
+
+// Action run miot action with input parameters
+func (x *MiIoDevice) Action(siid int, aiid int, in []interface{}) (*miio.ActionResult, error) {
+	if in == nil {
+		in = []interface{}{}
+	}
+
+	resp, err := x.Send("action", &miio.ActionRequest{Did: x.did(), Siid: siid, Aiid: aiid, In: in})
+	if err != nil {
+		return nil, err
+	}
+
+	var res *miio.ActionResult
+	if err := resp.DecodeResult(&res); err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, miio.ErrEmptyResponse
+	}
+	if res.Siid == 0 && res.Aiid == 0 {
+		res.Siid, res.Aiid = siid, aiid
+	}
+
+	return res, res.Err()
+}
@@ -0,0 +1,252 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MiotProperty is a property of miot device with service id
+type MiotProperty struct {
+	Siid int
+	miio.Property
+}
+
+// MiotAction is an action of miot device with service id
+type MiotAction struct {
+	Siid int
+	miio.Action
+}
+
+// MiotDevice is a generic device described by miot spec. Properties and actions named as
+// <service>.<name>, e.g. "light.on" or "light.toggle".
+type MiotDevice struct {
+	MiIoDevice
+	Spec      *miio.Details
+	specProps map[string]*MiotProperty // by full name, MiIoDevice.props keeps get_prop names of legacy devices
+	actions   map[string]*MiotAction
+}
+
+func NewMiotDevice(debug bool, model string, id string, ip string, token []byte, spec *miio.Details) *MiotDevice {
+	dev := &MiotDevice{
+		MiIoDevice: MiIoDevice{
+			deviceModel: model,
+			deviceType:  MIOT,
+			Id:          utils.ConvertHex(id),
+			Ip:          ip,
+			Token:       token,
+			debug:       debug,
+			requestId:   1,
+		},
+		Spec:      spec,
+		specProps: make(map[string]*MiotProperty),
+		actions:   make(map[string]*MiotAction),
+	}
+
+	services := make(map[string]bool)
+	for _, s := range spec.Services {
+		// device can have few services of the same type
+		name := s.Name()
+		if services[name] {
+			name = fmt.Sprintf("%s-%d", name, s.Id)
+		}
+		services[name] = true
+
+		for _, p := range s.Props {
+			dev.specProps[name+"."+p.Name()] = &MiotProperty{Siid: s.Id, Property: p}
+		}
+		for _, a := range s.Actions {
+			dev.actions[name+"."+a.Name()] = &MiotAction{Siid: s.Id, Action: a}
+		}
+	}
+
+	return dev
+}
+
+// Property return property by name or nil
+func (m *MiotDevice) Property(name string) *MiotProperty {
+	return m.specProps[name]
+}
+
+// Properties return names of readable properties
+func (m *MiotDevice) Properties() []string {
+	var res []string
+	for name, p := range m.specProps {
+		if p.Readable() {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Commands return names of writable properties and actions
+func (m *MiotDevice) Commands() []string {
+	var res []string
+	for name, p := range m.specProps {
+		if p.Writable() {
+			res = append(res, name)
+		}
+	}
+	for name := range m.actions {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// State read all readable properties. Properties failed on device are skipped.
+func (m *MiotDevice) State() (map[string]interface{}, error) {
+	names := m.Properties()
+	refs := make([]miio.PropRef, len(names))
+	for i, name := range names {
+		refs[i] = miio.PropRef{Siid: m.specProps[name].Siid, Piid: m.specProps[name].Id}
+	}
+
+	res, err := m.GetProperties(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]interface{})
+	for i, r := range res {
+		var v interface{}
+		if r.DecodeValue(&v) == nil {
+			state[names[i]] = v
+		}
+	}
+
+	return state, nil
+}
+
+// Set write property by name
+func (m *MiotDevice) Set(prop string, value interface{}) (*miio.Response, error) {
+	p := m.specProps[prop]
+	if p == nil || !p.Writable() {
+		return nil, fmt.Errorf("property %s is not writable", prop)
+	}
+
+	v, err := convertValue(p.Format, value)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.Send("set_properties", []miio.PropValue{{Did: m.did(), Siid: p.Siid, Piid: p.Id, Value: v}})
+	if err != nil {
+		return resp, err
+	}
+
+	var res []miio.PropResult
+	if err := resp.DecodeResult(&res); err != nil {
+		return resp, err
+	}
+	for _, r := range res {
+		if err := r.Err(); err != nil {
+			return resp, err
+		}
+	}
+
+	return resp, nil
+}
+
+// Call run action by name, other methods sent to device as is
+func (m *MiotDevice) Call(ctx context.Context, method string, params interface{}) (*miio.Response, error) {
+	a := m.actions[method]
+	if a == nil {
+		return m.MiIoDevice.Call(ctx, method, params)
+	}
+
+	var in []interface{}
+	switch v := params.(type) {
+	case nil:
+		in = []interface{}{}
+	case []interface{}:
+		in = v
+	default:
+		in = []interface{}{v}
+	}
+
+	resp, err := m.MiIoDevice.Call(ctx, "action", &miio.ActionRequest{Did: m.did(), Siid: a.Siid, Aiid: a.Id, In: in})
+	if err != nil {
+		return resp, err
+	}
+
+	var res miio.ActionResult
+	if err := resp.DecodeResult(&res); err != nil {
+		return resp, err
+	}
+	res.Siid, res.Aiid = a.Siid, a.Id
+
+	return resp, res.Err()
+}
+
+func (m *MiotDevice) String() string {
+	props, _ := json.Marshal(m.Properties())
+	commands, _ := json.Marshal(m.Commands())
+	retain := m.MiIoDevice.Retain()
+	m.state.Lock()
+	defer m.state.Unlock()
+	return fmt.Sprintf(`{%s,"ip":"%s","timestamp":%d,"properties":%s,"commands":%s}`,
+		retain, m.Ip, m.Timestamp, props, commands)
+}
+
+func (m *MiotDevice) Retain() string {
+	return fmt.Sprintf(`{%s}`, m.MiIoDevice.Retain())
+}
+
+// convertValue convert value received from mqtt to property format
+func convertValue(format string, value interface{}) (interface{}, error) {
+	s, isString := value.(string)
+
+	switch {
+	case format == "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		}
+		if isString {
+			switch strings.ToLower(s) {
+			case "true", "on", "1":
+				return true, nil
+			case "false", "off", "0":
+				return false, nil
+			}
+		}
+	case strings.HasPrefix(format, "int") || strings.HasPrefix(format, "uint"):
+		switch v := value.(type) {
+		case float64:
+			return int64(v), nil
+		case bool:
+			if v {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		if isString {
+			if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return v, nil
+			}
+		}
+	case format == "float":
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		}
+		if isString {
+			if v, err := strconv.ParseFloat(s, 64); err == nil {
+				return v, nil
+			}
+		}
+	default:
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("wrong value %v for %s property", value, format)
+}
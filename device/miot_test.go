@@ -0,0 +1,196 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/miio/sim"
+	"testing"
+)
+
+var lightSpec = &miio.Details{
+	Type: "urn:miot-spec-v2:device:light:0000A001:sim-light:1",
+	Services: []miio.Service{{
+		Id:   2,
+		Type: "urn:miot-spec-v2:service:light:00007802:sim-light:1",
+		Props: []miio.Property{
+			{Id: 1, Type: "urn:miot-spec-v2:property:on:00000006:sim-light:1", Format: "bool", Access: []string{"read", "write"}},
+			{Id: 2, Type: "urn:miot-spec-v2:property:brightness:0000000D:sim-light:1", Format: "uint8", Access: []string{"read", "write"}},
+			{Id: 3, Type: "urn:miot-spec-v2:property:mode:00000008:sim-light:1", Format: "uint8", Access: []string{"write"}},
+			{Id: 4, Type: "urn:miot-spec-v2:property:fault:00000009:sim-light:1", Format: "uint8", Access: []string{"read"}},
+		},
+		Actions: []miio.Action{{Id: 1, Type: "urn:miot-spec-v2:action:toggle:00002811:sim-light:1"}},
+	}},
+}
+
+// manySpec return spec of device with n read-write properties in one service
+func manySpec(n int) *miio.Details {
+	s := miio.Service{Id: 2, Type: "urn:miot-spec-v2:service:sensor:00007802:sim:1"}
+	for i := 1; i <= n; i++ {
+		s.Props = append(s.Props, miio.Property{Id: i, Type: fmt.Sprintf("urn:miot-spec-v2:property:p%d:00000001:sim:1", i),
+			Format: "uint8", Access: []string{"read", "write"}})
+	}
+	return &miio.Details{Services: []miio.Service{s}}
+}
+
+func connectMiot(t *testing.T, s *sim.Device, id string, spec *miio.Details) *MiotDevice {
+	dev := NewMiotDevice(false, "sim.light", id, "", testToken, spec)
+	if err := dev.Connect(s.Addr().IP.String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+func TestPropertyChunks(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x3000c, Token: testToken, Addr: "127.0.0.50:54321", Spec: manySpec(20)})
+	dev := connect(t, s, 0x3000c)
+
+	var refs []miio.PropRef
+	var values []miio.PropValue
+	for i := 1; i <= 20; i++ {
+		refs = append(refs, miio.PropRef{Siid: 2, Piid: i})
+		values = append(values, miio.PropValue{Siid: 2, Piid: i, Value: i})
+	}
+
+	// 16 values are written by 15 and 1, 20 are read by 15 and 5, results keep requested order
+	if res, err := dev.SetProperties(values[:16]); err != nil || len(res) != 16 {
+		t.Fatalf("unexpected result %+v, error %v", res, err)
+	}
+	res, err := dev.GetProperties(refs)
+	if err != nil || len(res) != 20 {
+		t.Fatalf("unexpected result %+v, error %v", res, err)
+	}
+	for i, r := range res {
+		var v int
+		if err := r.DecodeValue(&v); err != nil || r.Piid != i+1 || (i < 16 && v != i+1) {
+			t.Fatalf("unexpected result %+v, error %v", r, err)
+		}
+	}
+
+	var sizes []int
+	for _, r := range s.Requests() {
+		items, _ := r.Params.([]interface{})
+		sizes = append(sizes, len(items))
+		for _, item := range items {
+			if did := item.(map[string]interface{})["did"]; did != fmt.Sprint(0x3000c) {
+				t.Fatalf("request %s has did %v", r.Method, did)
+			}
+		}
+	}
+	if fmt.Sprint(sizes) != "[15 1 15 5]" {
+		t.Fatalf("unexpected request sizes %v", sizes)
+	}
+}
+
+func TestPropertyResults(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x3000d, Token: testToken, Addr: "127.0.0.51:54321", Spec: lightSpec})
+	dev := connect(t, s, 0x3000d)
+
+	// per property error codes are returned in results, request itself succeeds
+	res, err := dev.GetProperties([]miio.PropRef{{Siid: 2, Piid: 1}, {Siid: 2, Piid: 3}, {Siid: 9, Piid: 1}})
+	if err != nil || len(res) != 3 {
+		t.Fatalf("unexpected result %+v, error %v", res, err)
+	}
+	var me *miio.MiotError
+	if res[0].Err() != nil || !errors.As(res[1].Err(), &me) || me.Code != -4001 || me.Piid != 3 || res[2].Err() == nil {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	var v interface{}
+	if err := res[1].DecodeValue(&v); !errors.As(err, &me) {
+		t.Fatalf("value of failed property decoded: %v", err)
+	}
+
+	// device answering less results than asked is an error
+	s.Handle("get_properties", func(method string, params json.RawMessage) (interface{}, *miio.ResponseError) {
+		return []map[string]interface{}{{"did": "1", "siid": 2, "piid": 1, "code": 0, "value": true}}, nil
+	})
+	if _, err := dev.GetProperties([]miio.PropRef{{Siid: 2, Piid: 1}, {Siid: 2, Piid: 2}}); err == nil {
+		t.Fatal("result count mismatch accepted")
+	}
+}
+
+func TestMiotDevice(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x3000e, Token: testToken, Addr: "127.0.0.52:54321", Spec: lightSpec})
+	dev := connectMiot(t, s, "3000e", lightSpec)
+
+	if fmt.Sprint(dev.Properties()) != "[light.brightness light.fault light.on]" ||
+		fmt.Sprint(dev.Commands()) != "[light.brightness light.mode light.on light.toggle]" {
+		t.Fatalf("unexpected properties %v, commands %v", dev.Properties(), dev.Commands())
+	}
+
+	// mqtt values are converted to property format
+	if _, err := dev.Set("light.on", "on"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dev.Set("light.brightness", "40"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Property(2, 1) != true || s.Property(2, 2) != float64(40) {
+		t.Fatalf("unexpected device values %v, %v", s.Property(2, 1), s.Property(2, 2))
+	}
+	if _, err := dev.Set("light.fault", 1); err == nil {
+		t.Fatal("read only property is set")
+	}
+	if _, err := dev.Set("light.brightness", "bright"); err == nil {
+		t.Fatal("wrong value is set")
+	}
+
+	state, err := dev.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["light.on"] != true || state["light.brightness"] != float64(40) || len(state) != 3 {
+		t.Fatalf("unexpected state %v", state)
+	}
+
+	// action is called by name, other methods go to device as is
+	if _, err := dev.Call(context.Background(), "light.toggle", nil); err != nil {
+		t.Fatal(err)
+	}
+	reqs := s.Requests()
+	if a := reqs[len(reqs)-1]; a.Method != "action" || fmt.Sprint(a.Params) != "map[aiid:1 did:196622 in:[] siid:2]" {
+		t.Fatalf("unexpected request %+v", a)
+	}
+	if _, err := dev.Call(context.Background(), "miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// failed action gives miot error
+	s.Handle("action", func(method string, params json.RawMessage) (interface{}, *miio.ResponseError) {
+		return map[string]interface{}{"code": -4004}, nil
+	})
+	var me *miio.MiotError
+	if _, err := dev.Call(context.Background(), "light.toggle", nil); !errors.As(err, &me) || me.Code != -4004 || me.Aiid != 1 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	for _, c := range []struct {
+		format string
+		value  interface{}
+		want   interface{}
+	}{
+		{"bool", true, true},
+		{"bool", "ON", true},
+		{"bool", "0", false},
+		{"bool", float64(2), true},
+		{"bool", "maybe", nil},
+		{"uint8", float64(40.7), int64(40)},
+		{"int32", "-5", int64(-5)},
+		{"uint8", true, 1},
+		{"uint8", "4.5", nil},
+		{"float", "0.5", 0.5},
+		{"float", float64(3), float64(3)},
+		{"float", false, nil},
+		{"string", "auto", "auto"},
+	} {
+		v, err := convertValue(c.format, c.value)
+		if v != c.want || (err == nil) != (c.want != nil) {
+			t.Errorf("%s %v: got %v (%T), error %v", c.format, c.value, v, v, err)
+		}
+	}
+}
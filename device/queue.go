@@ -0,0 +1,110 @@
+package device
+
+import (
+	"context"
+	"manager_xiaomi/miio"
+	"time"
+)
+
+// call is a request waiting in device queue
+type call struct {
+	ctx    context.Context
+	method string
+	params interface{}
+	res    chan callResult
+}
+
+type callResult struct {
+	resp *miio.Response
+	err  error
+}
+
+// Call put request to device queue and wait for the answer. Requests are sent one by one by device
+// goroutine, so commands and pollers can use device at the same time. Without deadline in ctx request
+// waits for the session restore (QueueWait) and answer timeout.
+func (x *MiIoDevice) Call(ctx context.Context, method string, params interface{}) (*miio.Response, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, QueueWait+timeout*2)
+		defer cancel()
+	}
+
+	c := &call{ctx: ctx, method: method, params: params, res: make(chan callResult, 1)}
+
+	select {
+	case x.queue() <- c:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case r := <-c.res:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// queue return request queue, device goroutine started on first use. Only x.state is taken, so Call isn't
+// blocked by running request.
+func (x *MiIoDevice) queue() chan *call {
+	x.state.Lock()
+	defer x.state.Unlock()
+
+	if x.calls == nil {
+		x.calls = make(chan *call)
+		x.quit = make(chan struct{})
+		go x.serve(x.calls, x.quit)
+	}
+	return x.calls
+}
+
+// stopQueue stop device goroutine
+func (x *MiIoDevice) stopQueue() {
+	x.state.Lock()
+	defer x.state.Unlock()
+
+	if x.quit != nil {
+		close(x.quit)
+		x.calls, x.quit = nil, nil
+	}
+}
+
+func (x *MiIoDevice) serve(calls chan *call, quit chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case c := <-calls:
+			if err := c.ctx.Err(); err != nil {
+				c.res <- callResult{err: err}
+				continue
+			}
+			resp, err := x.request(c.ctx, c.method, c.params)
+			c.res <- callResult{resp: resp, err: err}
+		}
+	}
+}
+
+// waitReady check session before request. Request waits up to QueueWait while session is restoring.
+func (x *MiIoDevice) waitReady(ctx context.Context) error {
+	x.state.Lock()
+	ready := x.ready
+	x.state.Unlock()
+
+	if ready == nil {
+		return nil
+	}
+	if QueueWait == 0 {
+		return ErrOffline
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(QueueWait):
+		return ErrOffline
+	}
+}
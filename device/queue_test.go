@@ -0,0 +1,118 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/miio/sim"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCallContext(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x30009, Token: testToken, Addr: "127.0.0.47:54321"})
+	dev := connect(t, s, 0x30009)
+
+	// slow request holds device, queued call gives up with its ctx instead of waiting for it
+	s.SetFaults(sim.Faults{Delay: timeout / 2})
+	slow := make(chan error)
+	go func() {
+		_, err := dev.Send("miIO.info", nil)
+		slow <- err
+	}()
+	time.Sleep(timeout / 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout/10)
+	defer cancel()
+	start := time.Now()
+	if _, err := dev.Call(ctx, "miIO.info", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d > timeout/4 {
+		t.Fatalf("call waited %s", d)
+	}
+	// device is read while request is running
+	if dev.IP() != "127.0.0.47" || dev.String() == "" {
+		t.Fatalf("unexpected ip %q", dev.IP())
+	}
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echo answer get_prop with its params, so every caller can check it got answer to own request
+func echo(method string, params json.RawMessage) (interface{}, *miio.ResponseError) {
+	return params, nil
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x3000a, Token: testToken, Addr: "127.0.0.48:54321"})
+	s.Handle("get_prop", echo)
+	dev := connect(t, s, 0x3000a)
+
+	// every answer comes twice, second copy is dropped as stale by the next request
+	s.SetFaults(sim.Faults{Duplicate: true})
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			resp, err := dev.Send("get_prop", []string{name})
+			if err != nil {
+				errs <- err
+				return
+			}
+			var values []string
+			if err := resp.DecodeResult(&values); err != nil || len(values) != 1 || values[0] != name {
+				errs <- fmt.Errorf("%s: answer %s", name, resp.Result)
+			}
+		}(fmt.Sprintf("prop%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	ids := make(map[int]bool)
+	for _, r := range s.Requests() {
+		if ids[r.Id] {
+			t.Fatalf("request id %d is sent twice", r.Id)
+		}
+		ids[r.Id] = true
+	}
+	if len(ids) != 10 {
+		t.Fatalf("%d requests sent", len(ids))
+	}
+}
+
+func TestReorderedAnswers(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x3000b, Token: testToken, Addr: "127.0.0.49:54321"})
+	s.Handle("get_prop", echo)
+	dev := connect(t, s, 0x3000b)
+
+	// first answer is held back and comes after the answer of the next request
+	s.SetFaults(sim.Faults{Reorder: true})
+	if _, err := dev.Send("get_prop", []string{"first"}); err == nil {
+		t.Fatal("held answer received")
+	}
+	s.SetFaults(sim.Faults{})
+	for _, name := range []string{"second", "third"} {
+		resp, err := dev.Send("get_prop", []string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// answer to the first request is dropped, it is not taken for the third one
+		var values []string
+		if err := resp.DecodeResult(&values); err != nil || len(values) != 1 || values[0] != name {
+			t.Fatalf("%s: answer %s", name, resp.Result)
+		}
+	}
+	if !dev.Connected() {
+		t.Fatal("device disconnected")
+	}
+}
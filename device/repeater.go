@@ -58,7 +58,7 @@ func NewRepeater(debug bool, model string, id string, ip string, token []byte) *
 			Ip:          ip,
 			Token:       token,
 			debug:       debug,
-			request:     1,
+			requestId:   1,
 		},
 	}
 
@@ -66,8 +66,11 @@ func NewRepeater(debug bool, model string, id string, ip string, token []byte) *
 }
 
 func (b *Repeater) String() string {
+	retain := b.MiIoDevice.Retain()
+	b.state.Lock()
+	defer b.state.Unlock()
 	return fmt.Sprintf(`{%s,"ip":"%s","id":"%x","token":"%x","timestamp":%d}`,
-		b.MiIoDevice.Retain(), b.Ip, b.Id, b.Token, b.Timestamp)
+		retain, b.Ip, b.Id, b.Token, b.Timestamp)
 }
 
 func (b *Repeater) Retain() string {
@@ -0,0 +1,71 @@
+package device
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	// delay between attempts to restore session grows from ReconnectMin up to ReconnectMax
+	ReconnectMin = time.Second
+	ReconnectMax = time.Minute
+	// QueueWait is how long request waits for restored session, zero fails requests immediately
+	QueueWait time.Duration
+	// session is lost after this many requests in a row are not answered, send error loses it at once
+	lostTimeouts = 3
+
+	ErrOffline = errors.New("device offline, session is restoring")
+)
+
+// lost close broken session and start supervisor to restore it. Called with x.lock held.
+func (x *MiIoDevice) lost(reason error) {
+	x.disconnect()
+
+	x.state.Lock()
+	defer x.state.Unlock()
+	if x.closed || x.ready != nil {
+		return
+	}
+
+	log.Printf("device %x session lost: %s", x.Id, reason)
+	x.ready = make(chan struct{})
+	go x.supervise(x.ready)
+}
+
+// supervise repeat handshake with exponential backoff until device answers or Close called
+func (x *MiIoDevice) supervise(ready chan struct{}) {
+	delay := ReconnectMin
+	for {
+		time.Sleep(delay)
+
+		x.lock.Lock()
+		if x.closed {
+			x.setReady()
+			x.lock.Unlock()
+			close(ready)
+			return
+		}
+
+		if _, err := x.handshake(x.Ip); err == nil {
+			x.setReady()
+			x.lock.Unlock()
+			close(ready)
+			log.Printf("device %x session restored", x.Id)
+			return
+		}
+		x.lock.Unlock()
+
+		delay *= 2
+		if delay > ReconnectMax {
+			delay = ReconnectMax
+		}
+	}
+}
+
+// setReady mark session restore finished
+func (x *MiIoDevice) setReady() {
+	x.state.Lock()
+	x.ready = nil
+	x.state.Unlock()
+}
@@ -0,0 +1,175 @@
+package device
+
+import (
+	"errors"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/miio/sim"
+	"os"
+	"testing"
+	"time"
+)
+
+var testToken = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+func TestMain(m *testing.M) {
+	// lost sessions are found and restored quickly, values are not changed back as supervisors may still run
+	timeout = time.Millisecond * 300
+	ReconnectMin = time.Millisecond * 100
+	ReconnectMax = time.Millisecond * 200
+	os.Exit(m.Run())
+}
+
+func startSim(t *testing.T, cfg sim.Config) *sim.Device {
+	s, err := sim.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestConnectFailed(t *testing.T) {
+	dev := NewMiIoDevice(false, 0x30001, "")
+	dev.Token = testToken
+	defer dev.Close()
+
+	// nothing answers yet, address is not kept so manager connects device on next discovery
+	if err := dev.Connect("127.0.0.41"); err == nil {
+		t.Fatal("connect to missing device succeeded")
+	}
+	if dev.IP() != "" || dev.Connected() {
+		t.Fatalf("failed device keeps ip %q, connected %v", dev.IP(), dev.Connected())
+	}
+
+	startSim(t, sim.Config{Id: 0x30001, Token: testToken, Addr: "127.0.0.41:54321"})
+	if err := dev.Connect("127.0.0.41"); err != nil {
+		t.Fatal(err)
+	}
+	if dev.IP() != "127.0.0.41" || !dev.Connected() {
+		t.Fatalf("connected device has ip %q, connected %v", dev.IP(), dev.Connected())
+	}
+	if _, err := dev.Send("miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connect create device and connect it to simulated device
+func connect(t *testing.T, s *sim.Device, id uint32) *MiIoDevice {
+	dev := NewMiIoDevice(false, id, "")
+	dev.Token = testToken
+	if err := dev.Connect(s.Addr().IP.String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+func waitConnected(t *testing.T, dev *MiIoDevice) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 3); !dev.Connected(); time.Sleep(time.Millisecond * 20) {
+		if time.Now().After(deadline) {
+			t.Fatal("session is not restored")
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x30005, Token: testToken, Addr: "127.0.0.43:54321"})
+	dev := connect(t, s, 0x30005)
+
+	// dropped answer fails only its request, session is kept
+	s.SetFaults(sim.Faults{Drop: 1})
+	if _, err := dev.Send("miIO.info", nil); err == nil || errors.Is(err, ErrOffline) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !dev.Connected() {
+		t.Fatal("device disconnected after one lost answer")
+	}
+	s.SetFaults(sim.Faults{})
+	if _, err := dev.Send("miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// device not answering several times breaks session, requests fail fast while it is restored
+	s.SetFaults(sim.Faults{Drop: 1})
+	for i := 0; i < lostTimeouts; i++ {
+		if _, err := dev.Send("miIO.info", nil); err == nil || errors.Is(err, ErrOffline) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if dev.Connected() {
+		t.Fatal("device connected after lost answers")
+	}
+	if _, err := dev.Send("miIO.info", nil); !errors.Is(err, ErrOffline) {
+		t.Fatalf("request during restore: %v", err)
+	}
+
+	// hello is answered, supervisor restores session with the new timestamp
+	s.SetFaults(sim.Faults{})
+	waitConnected(t, dev)
+	if _, err := dev.Send("miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// slow answer within timeout is fine, too late one fails request and is dropped as stale by the next one
+	s.SetFaults(sim.Faults{Delay: timeout / 3})
+	if _, err := dev.Send("miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+	s.SetFaults(sim.Faults{Delay: timeout * 3 / 2})
+	if _, err := dev.Send("miIO.info", nil); err == nil {
+		t.Fatal("late answer accepted")
+	}
+	s.SetFaults(sim.Faults{})
+	resp, err := dev.Send("miIO.info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs := s.Requests(); resp.Id != reqs[len(reqs)-1].Id {
+		t.Fatalf("answer id %d, last request %+v", resp.Id, reqs[len(reqs)-1])
+	}
+	if !dev.Connected() {
+		t.Fatal("device disconnected after late answer")
+	}
+}
+
+func TestDeviceRestart(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x30006, Token: testToken, Addr: "127.0.0.44:54321"})
+	dev := connect(t, s, 0x30006)
+
+	// device power cycle, requests wait for the session
+	s.Close()
+	if _, err := dev.Send("miIO.info", nil); err == nil {
+		t.Fatal("request to stopped device succeeded")
+	}
+	QueueWait = time.Second * 3
+	defer func() { QueueWait = 0 }()
+	startSim(t, sim.Config{Id: 0x30006, Token: testToken, Addr: "127.0.0.44:54321"})
+	if _, err := dev.Send("miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.Connected() {
+		t.Fatal("device is not connected after restore")
+	}
+}
+
+func TestBadChecksum(t *testing.T) {
+	s := startSim(t, sim.Config{Id: 0x30007, Token: testToken, Addr: "127.0.0.45:54321"})
+	dev := connect(t, s, 0x30007)
+
+	// forged answers are dropped, request fails as there is no valid answer
+	before := miio.RejectedPackets()
+	s.SetFaults(sim.Faults{BadChecksum: true})
+	if _, err := dev.Send("miIO.info", nil); err == nil {
+		t.Fatal("answer with broken checksum accepted")
+	}
+	if n := miio.RejectedPackets().Checksum - before.Checksum; n != 1 {
+		t.Fatalf("%d packets rejected by checksum", n)
+	}
+
+	// session is kept, device answering right again is used at once
+	s.SetFaults(sim.Faults{})
+	if _, err := dev.Send("miIO.info", nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,50 +1,377 @@
 package discovery
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"manager_xiaomi/device"
 	"manager_xiaomi/miio"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	discoveryPort     = 54321
-	discoveryInterval = time.Second * 10
+	discoveryPort = 54321
+	// hello packet sent with this interval
+	Interval = time.Second * 10
+	// Multicast is target for hello packets asked besides configured ones unless NoMulticast is set
+	Multicast = "224.0.0.251"
+	// Rate is default number of sweep hello packets per second
+	Rate = 50
+	// Sweep is default pause between subnet sweeps
+	Sweep = time.Minute * 10
+
+	// largest network allowed to sweep
+	maxSweepHosts = 1 << 16
+	// pause after socket read error, so broken socket doesn't spin reader
+	readBackoff = time.Millisecond * 100
+
+	ErrTarget = errors.New("target should be ipv4 address or network")
 )
 
-func NewDiscovery(debug bool, discovery chan *device.MiIoDevice) error {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: discoveryPort})
+type Config struct {
+	Listen      string        // local udp address, ":54321" if empty
+	Targets     []string      // addresses (unicast or multicast) and networks (10.20.0.0/22) to send hello to
+	NoMulticast bool          // don't send hello to Multicast
+	Broadcast   bool          // send hello to broadcast address of every interface
+	Rate        int           // sweep hello packets per second, Rate if zero
+	Interval    time.Duration // Interval if zero
+	Sweep       time.Duration // pause between sweeps of networks, Sweep if zero
+	Mdns        bool          // browse _miio._udp.local services over mdns
+}
+
+/*
+Start send hello packets and report answered devices until ctx is done. Error returned only if config is wrong or
+listen address can't be used.
+
+Every interval hello is sent to multicast address (unless NoMulticast is set), broadcast address of every
+interface, configured addresses and addresses of devices found before. Networks are swept host by host with rate
+limit, devices found by sweep are asked every interval as well. Device is reported once per interval even if it
+answered to several hello packets.
+
+With Mdns devices announced as _miio._udp.local services are reported too, their model is taken from
+instance name and token is not known.
+*/
+func Start(ctx context.Context, debug bool, cfg Config, discovery chan *device.MiIoDevice) error {
+	if cfg.Listen == "" {
+		cfg.Listen = ":54321"
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = Interval
+	}
+	if cfg.Rate == 0 {
+		cfg.Rate = Rate
+	}
+	if cfg.Sweep == 0 {
+		cfg.Sweep = Sweep
+	}
+
+	var hosts []net.IP
+	var networks []*net.IPNet
+	targets := cfg.Targets
+	if !cfg.NoMulticast {
+		targets = append([]string{Multicast}, targets...)
+	}
+	for _, t := range targets {
+		ip, n, err := ParseTarget(t)
+		if err != nil {
+			return err
+		}
+		if n != nil {
+			networks = append(networks, n)
+		} else {
+			hosts = append(hosts, ip)
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Listen)
 	if err != nil {
 		return err
 	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+
+	s := &session{
+		debug:    debug,
+		cfg:      cfg,
+		conn:     conn,
+		hosts:    hosts,
+		found:    make(map[string]bool),
+		reported: make(map[uint32]report),
+	}
+
+	var mconn *net.UDPConn
+	if cfg.Mdns {
+		if mconn, err = net.ListenMulticastUDP("udp4", nil, mdnsGroup); err != nil {
+			conn.Close()
+			return err
+		}
+	}
 
 	go func() {
-		// send broadcast hello packet
-		for {
-			helloPacket, err := miio.NewPacket(miio.HelloPacketDeviceId, nil, uint32(time.Now().Unix()), nil)
-			if err == nil {
-				hello, err := helloPacket.Pack()
-				if err == nil {
-					conn.WriteToUDP(hello, &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: discoveryPort})
-				}
-			}
-			time.Sleep(discoveryInterval)
+		<-ctx.Done()
+		conn.Close()
+		if mconn != nil {
+			mconn.Close()
 		}
 	}()
 
-	// read answers for hello
-	buffer := make([]byte, 0x20)
+	if mconn != nil {
+		go s.browse(ctx, mconn)
+		go s.listen(ctx, mconn, discovery)
+	}
+	go s.send(ctx)
+	if len(networks) > 0 {
+		go s.sweep(ctx, networks)
+	}
+	go s.receive(ctx, discovery)
+	return nil
+}
+
+// ParseTarget check discovery target, network is returned for subnet
+func ParseTarget(target string) (net.IP, *net.IPNet, error) {
+	if strings.Contains(target, "/") {
+		_, n, err := net.ParseCIDR(target)
+		if err != nil || n.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("%w: %q", ErrTarget, target)
+		}
+		ones, bits := n.Mask.Size()
+		if 1<<(bits-ones) > maxSweepHosts {
+			return nil, nil, fmt.Errorf("%w: network %s is too large to sweep, use /16 or smaller", ErrTarget, target)
+		}
+		return nil, n, nil
+	}
+
+	ip := net.ParseIP(target)
+	if ip == nil || ip.To4() == nil {
+		return nil, nil, fmt.Errorf("%w: %q", ErrTarget, target)
+	}
+	return ip, nil, nil
+}
+
+// report keep last time device was sent to discovery channel
+type report struct {
+	ip   string
+	time time.Time
+}
+
+type session struct {
+	debug    bool
+	cfg      Config
+	conn     *net.UDPConn
+	hosts    []net.IP
+	found    map[string]bool // addresses of answered devices
+	reported map[uint32]report
+	sync.Mutex
+}
+
+func newHello() []byte {
+	helloPacket, err := miio.NewPacket(miio.HelloPacketDeviceId, nil, uint32(time.Now().Unix()), nil)
+	if err != nil {
+		return nil
+	}
+	buf, _ := helloPacket.Pack()
+	return buf
+}
+
+func (s *session) hello(ip net.IP) {
+	if buf := newHello(); buf != nil {
+		s.conn.WriteToUDP(buf, &net.UDPAddr{IP: ip, Port: discoveryPort})
+	}
+}
+
+// send hello packet to every target every interval
+func (s *session) send(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		targets := append([]net.IP(nil), s.hosts...)
+		if s.cfg.Broadcast {
+			targets = append(targets, broadcasts()...)
+		}
+		s.Lock()
+		for ip := range s.found {
+			targets = append(targets, net.ParseIP(ip))
+		}
+		s.Unlock()
+
+		sent := make(map[string]bool)
+		for _, ip := range targets {
+			if !sent[ip.String()] {
+				sent[ip.String()] = true
+				s.hello(ip)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep send hello to every host of networks with rate limit
+func (s *session) sweep(ctx context.Context, networks []*net.IPNet) {
+	limit := time.NewTicker(time.Second / time.Duration(s.cfg.Rate))
+	defer limit.Stop()
+
 	for {
-		_, sourceAddr, err := conn.ReadFromUDP(buffer)
-		if err == nil {
-			if packet, err := miio.ParsePacket(0, nil, buffer); err == nil {
-				// looking for device with real deviceId
-				if packet.DeviceId != 0xffffffff {
-					if device := device.NewMiIoDevice(debug, packet.DeviceId, sourceAddr.IP.String()); device != nil {
-						discovery <- device
-					}
+		for _, n := range networks {
+			for ip := first(n); n.Contains(ip); ip = next(ip) {
+				if isEdge(ip, n) {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-limit.C:
 				}
+				s.hello(ip)
 			}
 		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.cfg.Sweep):
+		}
+	}
+}
+
+// receive read answers for hello
+func (s *session) receive(ctx context.Context, discovery chan *device.MiIoDevice) {
+	buffer := make([]byte, miio.MaxPacketSize)
+	for {
+		n, sourceAddr, err := s.conn.ReadFromUDP(buffer)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if !pause(ctx, err) {
+				return
+			}
+			continue
+		}
+		if miio.CheckFrame(buffer[:n]) != nil {
+			continue
+		}
+		packet, err := miio.ParsePacket(0, nil, buffer[:n])
+		// looking for device with real deviceId
+		if err != nil || packet.DeviceId == miio.HelloPacketDeviceId {
+			continue
+		}
+
+		ip := sourceAddr.IP.String()
+		if !s.report(packet.DeviceId, ip) {
+			continue
+		}
+
+		dev := device.NewMiIoDevice(s.debug, packet.DeviceId, ip)
+		dev.Token = packet.Token()
+		select {
+		case discovery <- dev:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pause wait after read error. False returned if reader should stop: socket is closed or ctx is done.
+func pause(ctx context.Context, err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	log.Println("discovery read error:", err)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(readBackoff):
+		return true
+	}
+}
+
+// report remember device address and check device should be reported. Answers to several hello packets of the
+// same round are reported once, device with changed address is reported at once.
+func (s *session) report(id uint32, ip string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	s.found[ip] = true
+	now := time.Now()
+	if last, ok := s.reported[id]; ok && last.ip == ip && now.Sub(last.time) < s.cfg.Interval/2 {
+		return false
+	}
+	s.reported[id] = report{ip: ip, time: now}
+	return true
+}
+
+// broadcasts return broadcast addresses of ipv4 interfaces
+func broadcasts() []net.IP {
+	var res []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok || n.IP.To4() == nil {
+				continue
+			}
+			ip := n.IP.To4()
+			mask := n.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			b := make(net.IP, net.IPv4len)
+			for i := range b {
+				b[i] = ip[i] | ^mask[i]
+			}
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func first(n *net.IPNet) net.IP {
+	return n.IP.To4().Mask(n.Mask)
+}
+
+func next(ip net.IP) net.IP {
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i]++
+		if res[i] != 0 {
+			break
+		}
+	}
+	return res
+}
+
+// isEdge check address is network or broadcast address, /31 and /32 networks have no such addresses
+func isEdge(ip net.IP, n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	if bits-ones < 2 {
+		return false
+	}
+	last := make(net.IP, net.IPv4len)
+	for i := range last {
+		last[i] = n.IP.To4()[i] | ^n.Mask[len(n.Mask)-net.IPv4len+i]
 	}
+	return ip.Equal(first(n)) || ip.Equal(last)
 }
@@ -0,0 +1,237 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"manager_xiaomi/device"
+	"manager_xiaomi/miio/sim"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var token = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+func TestParseTarget(t *testing.T) {
+	for target, ok := range map[string]bool{
+		"10.0.0.1":       true,
+		"224.0.0.251":    true,
+		"10.20.0.0/22":   true,
+		"10.0.0.0/16":    true,
+		"10.0.0.0/8":     false,
+		"fe80::1":        false,
+		"10.0.0.300":     false,
+		"10.0.0.0/33":    false,
+		"bulb.localhost": false,
+	} {
+		if _, _, err := ParseTarget(target); (err == nil) != ok {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+}
+
+func TestHosts(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/30")
+	var hosts []string
+	for ip := first(n); n.Contains(ip); ip = next(ip) {
+		if !isEdge(ip, n) {
+			hosts = append(hosts, ip.String())
+		}
+	}
+	if len(hosts) != 2 || hosts[0] != "10.0.0.1" || hosts[1] != "10.0.0.2" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	for i, addr := range []string{"127.0.0.21:54321", "127.0.0.22:54321"} {
+		s, err := sim.Start(sim.Config{Id: uint32(0x20001 + i), Token: token, Addr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	found := make(chan *device.MiIoDevice)
+	// 127.0.0.21 is asked directly and by sweep, it should be reported once
+	err := Start(ctx, false, Config{
+		Listen:   "127.0.0.1:0",
+		Targets:  []string{"127.0.0.21", "127.0.0.20/30"},
+		Rate:     100,
+		Interval: time.Second * 5,
+	}, found)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[uint32]int)
+	timeout := time.After(time.Second * 2)
+	for done := false; !done; {
+		select {
+		case dev := <-found:
+			seen[dev.ID()]++
+		case <-timeout:
+			done = true
+		}
+	}
+	if len(seen) != 2 || seen[0x20001] != 1 || seen[0x20002] != 1 {
+		t.Fatalf("unexpected reports %v", seen)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	// loopback address stands for multicast group, device answers hello sent there
+	s, err := sim.Start(sim.Config{Id: 0x20003, Token: token, Addr: "127.0.0.23:54321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer func(group string) { Multicast = group }(Multicast)
+	Multicast = "127.0.0.23"
+
+	for _, off := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		found := make(chan *device.MiIoDevice)
+		// configured targets don't replace multicast hello
+		err := Start(ctx, false, Config{
+			Listen:      "127.0.0.1:0",
+			Targets:     []string{"127.0.0.24"},
+			NoMulticast: off,
+			Interval:    time.Second * 5,
+		}, found)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case dev := <-found:
+			if off || dev.ID() != 0x20003 {
+				t.Errorf("no multicast %v: unexpected device %x", off, dev.ID())
+			}
+		case <-time.After(time.Millisecond * 500):
+			if !off {
+				t.Error("device is not found by multicast hello")
+			}
+		}
+		cancel()
+	}
+}
+
+func TestPause(t *testing.T) {
+	// closed socket stops reader at once, other errors make it wait
+	ctx, cancel := context.WithCancel(context.Background())
+	if pause(ctx, fmt.Errorf("read: %w", net.ErrClosed)) {
+		t.Fatal("reader of closed socket is not stopped")
+	}
+	start := time.Now()
+	if !pause(ctx, errors.New("connection refused")) || time.Since(start) < readBackoff {
+		t.Fatal("reader is not paused")
+	}
+	cancel()
+	if pause(ctx, errors.New("connection refused")) {
+		t.Fatal("reader is not stopped with ctx")
+	}
+}
+
+func TestParseInstance(t *testing.T) {
+	for name, want := range map[string]string{
+		"yeelink-light-color1_miio12345678":                     "yeelink.light.color1 12345678",
+		"zhimi-airpurifier-ma4_miio305419896._miio._udp.local.": "zhimi.airpurifier.ma4 305419896",
+		"Chuangmi-Plug-M1_MIIO42":                               "chuangmi.plug.m1 42",
+		"yeelink-light-color1_miio":                             "",
+		"yeelink-light-color1_miio99999999999":                  "",
+		"_miio12345678":                                         "",
+		"printer._ipp._tcp.local.":                              "",
+	} {
+		got := ""
+		if model, id, ok := parseInstance(name); ok {
+			got = fmt.Sprintf("%s %d", model, id)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// mdnsResponse build response with ptr, srv and (if ip is set) a records for instance
+func mdnsResponse(t *testing.T, instance string, ip net.IP) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.StartAnswers()
+	name := dnsmessage.MustNewName(instance + "." + mdnsService)
+	host := dnsmessage.MustNewName(instance + ".local.")
+	hdr := func(n dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: n, Type: typ, Class: dnsmessage.ClassINET, TTL: 120}
+	}
+	b.PTRResource(hdr(dnsmessage.MustNewName("_http._tcp.local."), dnsmessage.TypePTR),
+		dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("printer_miio1._http._tcp.local.")})
+	b.PTRResource(hdr(dnsmessage.MustNewName(mdnsService), dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: name})
+	if ip != nil {
+		b.StartAdditionals()
+		b.SRVResource(hdr(name, dnsmessage.TypeSRV), dnsmessage.SRVResource{Port: 54321, Target: host})
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip.To4())
+		b.AResource(hdr(host, dnsmessage.TypeA), a)
+	}
+	buf, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestMdns(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	group := mdnsGroup
+	mdnsGroup = responder.LocalAddr().(*net.UDPAddr)
+	defer func() { mdnsGroup = group }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &session{cfg: Config{Interval: time.Second * 10}, found: make(map[string]bool), reported: make(map[uint32]report)}
+	found := make(chan *device.MiIoDevice)
+	go s.browse(ctx, conn)
+	go s.listen(ctx, conn, found)
+
+	// answer to query with address of other host, then announce without address records
+	buf := make([]byte, 1500)
+	responder.SetReadDeadline(time.Now().Add(time.Second * 2))
+	n, addr, err := responder.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := p.Question(); err != nil || q.Type != dnsmessage.TypePTR || q.Name.String() != mdnsService {
+		t.Fatalf("unexpected query %v %v", q, err)
+	}
+	responder.WriteToUDP(mdnsResponse(t, "yeelink-light-color1_miio12345678", net.IPv4(127, 0, 0, 31)), addr)
+	responder.WriteToUDP(mdnsResponse(t, "zhimi-airpurifier-ma4_miio87654321", nil), addr)
+
+	for _, want := range []string{"12345678 yeelink.light.color1 127.0.0.31", "87654321 zhimi.airpurifier.ma4 127.0.0.1"} {
+		select {
+		case dev := <-found:
+			if got := fmt.Sprintf("%d %s %s", dev.ID(), dev.Model(), dev.Ip); got != want || dev.Token != nil {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("%s is not reported", want)
+		}
+	}
+}
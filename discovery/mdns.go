@@ -0,0 +1,176 @@
+package discovery
+
+import (
+	"context"
+	"manager_xiaomi/device"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// mdns group and port, queries are sent and announcements are received here
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	// service browsed over mdns, instance name is <model with dashes>_miio<did>
+	mdnsService = "_miio._udp.local."
+	// first query is repeated after this delay, delay doubles up to mdnsMaxDelay
+	mdnsMinDelay = time.Second
+	mdnsMaxDelay = time.Hour
+)
+
+// announce is a miio service found in mdns answer
+type announce struct {
+	id    uint32
+	model string
+	ip    net.IP // nil if answer has no address record
+}
+
+// parseInstance get model and device id from service instance name like yeelink-light-color1_miio12345678,
+// full name with service suffix is accepted as well
+func parseInstance(name string) (string, uint32, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), "."+mdnsService)
+	i := strings.LastIndex(name, "_miio")
+	if i < 1 {
+		return "", 0, false
+	}
+	id, err := strconv.ParseUint(name[i+len("_miio"):], 10, 32)
+	if err != nil || id == 0 {
+		return "", 0, false
+	}
+	return strings.ReplaceAll(name[:i], "-", "."), uint32(id), true
+}
+
+// newQuery build mdns question for ptr records of miio service
+func newQuery() []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(mdnsService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	buf, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+// parseAnnounces return miio services of mdns response. Instances are taken from ptr and srv records,
+// address from a record of srv target.
+func parseAnnounces(buf []byte) []announce {
+	var p dnsmessage.Parser
+	h, err := p.Start(buf)
+	if err != nil || !h.Response {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	records, err := p.AllAnswers()
+	if err != nil {
+		return nil
+	}
+	// address records are usually in additional section, broken tail of message is ignored
+	if err := p.SkipAllAuthorities(); err == nil {
+		additionals, _ := p.AllAdditionals()
+		records = append(records, additionals...)
+	}
+
+	var instances []string
+	known := make(map[string]bool)
+	add := func(name string) {
+		if !known[name] {
+			known[name] = true
+			instances = append(instances, name)
+		}
+	}
+	targets := make(map[string]string)
+	addrs := make(map[string]net.IP)
+	for _, r := range records {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == mdnsService {
+				add(strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			if strings.HasSuffix(name, "."+mdnsService) {
+				add(name)
+				targets[name] = strings.ToLower(body.Target.String())
+			}
+		case *dnsmessage.AResource:
+			addrs[name] = net.IP(body.A[:])
+		}
+	}
+
+	var res []announce
+	for _, name := range instances {
+		model, id, ok := parseInstance(name)
+		if !ok {
+			continue
+		}
+		res = append(res, announce{id: id, model: model, ip: addrs[targets[name]]})
+	}
+	return res
+}
+
+// browse send mdns query with growing delay, devices announce themselves on start without query
+func (s *session) browse(ctx context.Context, conn *net.UDPConn) {
+	query := newQuery()
+	delay := mdnsMinDelay
+	for {
+		if query != nil {
+			conn.WriteToUDP(query, mdnsGroup)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > mdnsMaxDelay {
+			delay = mdnsMaxDelay
+		}
+	}
+}
+
+// listen read mdns responses and report announced miio devices, sender address is used if response
+// has no address record
+func (s *session) listen(ctx context.Context, conn *net.UDPConn, discovery chan *device.MiIoDevice) {
+	buffer := make([]byte, 9000)
+	for {
+		n, sourceAddr, err := conn.ReadFromUDP(buffer)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if !pause(ctx, err) {
+				return
+			}
+			continue
+		}
+
+		for _, a := range parseAnnounces(buffer[:n]) {
+			ip := sourceAddr.IP.String()
+			if a.ip != nil {
+				ip = a.ip.String()
+			}
+			if !s.report(a.id, ip) {
+				continue
+			}
+
+			dev := device.NewMiIoDevice(s.debug, a.id, ip)
+			dev.SetModel(a.model)
+			select {
+			case discovery <- dev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
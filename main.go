@@ -1,44 +1,216 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"github.com/MajaSuite/mqtt/client"
-	"github.com/MajaSuite/mqtt/packet"
 	"log"
+	"manager_xiaomi/cloud"
+	"manager_xiaomi/config"
 	"manager_xiaomi/device"
-	"manager_xiaomi/discovery"
+	"manager_xiaomi/manager"
 	"manager_xiaomi/miio"
+	"manager_xiaomi/registry"
+	"manager_xiaomi/tokens"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+var defaults = config.Default()
+
 var (
-	debug     = flag.Bool("debug", false, "print debuging hex dumps")
-	srv       = flag.String("mqtt", "127.0.0.1:1883", "mqtt server address")
-	clientid  = flag.String("clientid", "xiaomi-1", "client id for mqtt server")
-	keepalive = flag.Int("keepalive", 30, "keepalive timeout for mqtt server")
-	login     = flag.String("login", "", "login string for mqtt server")
-	pass      = flag.String("pass", "", "password string for mqtt server")
-	qos       = flag.Int("qos", 0, "qos to send/receive from mqtt")
-	reg       = flag.Bool("reg", false, "to register new device")
-	sid       = flag.String("sid", "myhome", "network name for registration")
-	key       = flag.String("key", "mypass", "network key for registration")
-	ip        = flag.String("ip", "192.168.1.1", "ip address of new device")
-	uid       = flag.Int("uid", 0, "mihome uid")
+	cfgfile    = flag.String("config", "", "json config file, flags and XIAOMI_<FLAG> environment variables override it")
+	debug      = flag.Bool("debug", defaults.Log.Debug, "print debuging hex dumps")
+	logfile    = flag.String("log", defaults.Log.File, "log file, stderr if empty")
+	srv        = flag.String("mqtt", defaults.Mqtt.Server, "mqtt server address")
+	clientid   = flag.String("clientid", defaults.Mqtt.ClientId, "client id for mqtt server")
+	keepalive  = flag.Int("keepalive", defaults.Mqtt.KeepAlive, "keepalive timeout for mqtt server")
+	login      = flag.String("login", defaults.Mqtt.Login, "login string for mqtt server")
+	pass       = flag.String("pass", defaults.Mqtt.Pass, "password string for mqtt server")
+	qos        = flag.Int("qos", defaults.Mqtt.Qos, "qos to send/receive from mqtt")
+	register   = flag.Bool("reg", false, "to register new device")
+	sid        = flag.String("sid", "myhome", "network name for registration")
+	key        = flag.String("key", "mypass", "network key for registration")
+	ip         = flag.String("ip", "192.168.1.1", "ip address of new device")
+	uid        = flag.Int("uid", 0, "mihome uid")
+	regfile    = flag.String("registry", defaults.Registry, "file with known devices and tokens")
+	specdir    = flag.String("specs", defaults.Specs, "directory to keep miot specs")
+	specurl    = flag.String("spec-url", defaults.SpecURL, "miot spec server (or local mirror) url")
+	seed       = flag.String("seed", "", "comma separated list of models to download specs for and exit")
+	hass       = flag.String("hass", defaults.Hass, "home assistant discovery prefix, empty to disable")
+	misses     = flag.Int("misses", defaults.Misses, "number of failed requests or discovery rounds to mark device offline")
+	reconnect  = flag.Duration("reconnect", defaults.Reconnect.Duration, "max delay between attempts to restore device session")
+	queuewait  = flag.Duration("queue-wait", defaults.QueueWait.Duration, "how long requests wait for device session restore, 0 to fail immediately")
+	poll       = flag.Duration("poll", defaults.Poll.Duration, "interval to poll device state, 0 to disable")
+	targets    = flag.String("targets", "", "comma separated addresses and networks (10.20.0.0/22) to send hello to")
+	multicast  = flag.Bool("multicast", defaults.Discovery.Multicast, "send hello to multicast address 224.0.0.251")
+	broadcast  = flag.Bool("broadcast", defaults.Discovery.Broadcast, "send hello to broadcast address of every interface")
+	mdns       = flag.Bool("mdns", defaults.Discovery.Mdns, "discover devices announced as _miio._udp.local over mdns")
+	accounturl = flag.String("cloud-account-url", cloud.DefaultAccountURL, "xiaomi account server for cloud command")
+	apiurl     = flag.String("cloud-api-url", cloud.DefaultAPIURL, "xiaomi api server for cloud command, {region} is replaced by region prefix")
 )
 
+// loadConfig read config file and apply environment variables and flags over it
+func loadConfig() (*config.Config, error) {
+	// environment is used for flags not set in command line, e.g. XIAOMI_QUEUE_WAIT for -queue-wait
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		env := "XIAOMI_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(env); ok && !set[f.Name] && err == nil {
+			if e := flag.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s=%q: %w", env, v, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := config.Default()
+	if *cfgfile != "" {
+		if cfg, err = config.Load(*cfgfile); err != nil {
+			return nil, err
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "debug":
+			cfg.Log.Debug = *debug
+		case "log":
+			cfg.Log.File = *logfile
+		case "mqtt":
+			cfg.Mqtt.Server = *srv
+		case "clientid":
+			cfg.Mqtt.ClientId = *clientid
+		case "keepalive":
+			cfg.Mqtt.KeepAlive = *keepalive
+		case "login":
+			cfg.Mqtt.Login = *login
+		case "pass":
+			cfg.Mqtt.Pass = *pass
+		case "qos":
+			cfg.Mqtt.Qos = *qos
+		case "registry":
+			cfg.Registry = *regfile
+		case "specs":
+			cfg.Specs = *specdir
+		case "spec-url":
+			cfg.SpecURL = *specurl
+		case "hass":
+			cfg.Hass = *hass
+		case "misses":
+			cfg.Misses = *misses
+		case "reconnect":
+			cfg.Reconnect.Duration = *reconnect
+		case "queue-wait":
+			cfg.QueueWait.Duration = *queuewait
+		case "poll":
+			cfg.Poll.Duration = *poll
+		case "targets":
+			cfg.Discovery.Targets = nil
+			if *targets != "" {
+				cfg.Discovery.Targets = strings.Split(*targets, ",")
+			}
+		case "multicast":
+			cfg.Discovery.Multicast = *multicast
+		case "broadcast":
+			cfg.Discovery.Broadcast = *broadcast
+		case "mdns":
+			cfg.Discovery.Mdns = *mdns
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
 func main() {
 	flag.Parse()
 
-	if *reg {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalln("can't open log file", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	specs := miio.NewSpecStore(cfg.Specs, cfg.SpecURL)
+	if *seed != "" {
+		log.Println("seed miot spec cache")
+		if err := specs.Seed(strings.Split(*seed, ",")); err != nil {
+			log.Println("error seed", err)
+		}
+		return
+	}
+
+	device.UseSpecs(specs)
+	// read by running devices without lock, so they are set once here and reload doesn't change them
+	device.ReconnectMax = cfg.Reconnect.Duration
+	device.QueueWait = cfg.QueueWait.Duration
+
+	reg, err := registry.Load(cfg.Registry)
+	if err != nil {
+		panic("can't load device registry " + err.Error())
+	}
+
+	// manager_xiaomi [flags] tokens <miio2.db|_mihome.sqlite|backup.ab|ios backup dir>...
+	if flag.Arg(0) == "tokens" {
+		if flag.NArg() < 2 {
+			log.Fatalln("usage: tokens <miio2.db|_mihome.sqlite|backup.ab|ios backup dir>...")
+		}
+		for _, path := range flag.Args()[1:] {
+			devices, err := tokens.Read(path)
+			if err != nil {
+				log.Fatalln("error read tokens", err)
+			}
+			importDevices(reg, devices)
+		}
+		return
+	}
+
+	// manager_xiaomi [flags] cloud <user> [region]..., password is taken from XIAOMI_CLOUD_PASS or stdin
+	if flag.Arg(0) == "cloud" {
+		if flag.NArg() < 2 {
+			log.Fatalln("usage: cloud <user> [region]...")
+		}
+		importCloud(reg, flag.Arg(1), flag.Args()[2:])
+		return
+	}
+
+	if *register {
 		log.Println("new device registration")
 
-		device := device.NewMiIoDevice(*debug, miio.HelloPacketDeviceId, *ip)
+		device := device.NewMiIoDevice(cfg.Log.Debug, miio.HelloPacketDeviceId, *ip)
 		err := device.Connect(*ip)
 		if err != nil {
 			log.Println("error connect", err)
 			return
 		}
 
+		// model is not known yet, ask device before it leave registration network
+		model, mac, err := manager.DeviceInfo(device)
+		if err != nil {
+			log.Println("error get device info", err)
+		}
+
+		if reg.Add(&registry.Entry{Id: fmt.Sprintf("%x", device.ID()), Model: model, Mac: mac, Token: fmt.Sprintf("%x", device.Token)}) {
+			if err := reg.Save(); err != nil {
+				log.Println("error save registry", err)
+			}
+		}
+
 		_, err = device.Send("miIO.config_router",
 			&miio.DeviceConfiguration{Ssid: *sid, Password: *key, Uid: *uid})
 		if err != nil {
@@ -49,54 +221,90 @@ func main() {
 	}
 
 	log.Println("starting manager_xiaomi")
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	// connect to mqtt
-	log.Println("try connect to mqtt")
-	var mqttId uint16 = 1
-	mqtt, err := client.Connect(*srv, *clientid, uint16(*keepalive), false, *login, *pass /* *debug */, false)
-	if err != nil {
-		panic("can't connect to mqtt server " + err.Error())
+	mc := cfg.Manager()
+	mc.Reload = func() (manager.Config, error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			return manager.Config{}, err
+		}
+		return cfg.Manager(), nil
 	}
 
-	log.Println("subscribe to managed topics")
-	sp := packet.NewSubscribe()
-	sp.Id = mqttId
-	sp.Topics = []packet.SubscribePayload{{Topic: "xiaomi/#", QoS: 1}}
-	mqtt.Send <- sp
-	mqttId++
+	if err := manager.Run(ctx, mc); err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	devices := make(map[uint32]device.Device)
+// importDevices print found devices and write tokens of miio devices to the registry
+func importDevices(reg *registry.Registry, devices []tokens.Device) {
+	changed := false
+	for _, d := range devices {
+		id, ok := d.Id()
+		if !ok || len(d.Token) != 32 {
+			fmt.Printf("skip     %-12s %-28s %s (no miio token)\n", d.Did, d.Model, d.Name)
+			continue
+		}
+		fmt.Printf("%-8x %-12s %-28s %-15s %s %s\n", id, d.Did, d.Model, d.Ip, d.Token, d.Name)
+		if reg.Merge(&registry.Entry{Id: fmt.Sprintf("%x", id), Model: d.Model, Name: d.Name, Token: d.Token, Mac: d.Mac}) {
+			changed = true
+		}
+	}
 
-	log.Println("start xiaomi discovery")
-	d := make(chan *device.MiIoDevice)
-	go discovery.NewDiscovery(*debug, d)
+	if changed {
+		if err := reg.Save(); err != nil {
+			log.Fatalln("error save registry", err)
+		}
+		log.Println("registry updated")
+	}
+}
 
-	for {
-		select {
-		case pkt := <-mqtt.Receive:
-			// todo
-			log.Println("mqtt receive", pkt)
+// importCloud read devices of xiaomi account in every region (all regions if empty) and write them to the registry
+func importCloud(reg *registry.Registry, user string, regions []string) {
+	password, ok := os.LookupEnv("XIAOMI_CLOUD_PASS")
+	if !ok {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalln("error read password", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if len(regions) == 0 {
+		regions = cloud.Regions
+	}
 
-		case dev := <-d:
-			if dev == nil {
-				continue
-			}
-			if devices[dev.ID()] != nil && devices[dev.ID()].IP() == "" {
-				log.Println("device", devices[dev.ID()])
-				err := devices[dev.ID()].Connect(dev.Ip)
-				if err != nil {
-					log.Println("error connect:", err)
-				} else {
-					p := packet.NewPublish()
-					p.Id = mqttId
-					p.Topic = fmt.Sprintf("xiaomi/%x", dev.ID())
-					p.QoS = packet.QoS(*qos)
-					mqttId++
-					p.Payload = devices[dev.ID()].String()
-					log.Println("payload=", p.Payload)
-					mqtt.Send <- p
-				}
-			}
+	for _, region := range regions {
+		if err := cloud.CheckRegion(region); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	c, err := cloud.NewClient(regions[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	c.AccountURL = *accounturl
+	c.APIURL = *apiurl
+	if err := c.Login(user, password); err != nil {
+		log.Fatalln("error login", err)
+	}
+
+	for _, region := range regions {
+		c.Region = region
+		list, err := c.Devices()
+		if err != nil {
+			log.Println("error get devices of region", region, err)
+			continue
+		}
+		log.Printf("region %s: %d devices", region, len(list))
+
+		var devices []tokens.Device
+		for _, d := range list {
+			devices = append(devices, tokens.Device{Did: d.Did, Model: d.Model, Name: d.Name, Ip: d.LocalIp, Mac: d.Mac, Token: d.Token})
 		}
+		importDevices(reg, devices)
 	}
 }
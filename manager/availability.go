@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"manager_xiaomi/miio"
+	"sync"
+	"time"
+)
+
+const (
+	statusTopic = topicPrefix + "/status"
+	online      = "online"
+	offline     = "offline"
+)
+
+// deviceState keep availability of one device
+type deviceState struct {
+	online   bool
+	misses   int
+	lastSeen time.Time
+}
+
+// availability publish retained xiaomi/<id>/available when device become online or offline. Device marked
+// offline after configured number of misses: failed requests, failed polls or discovery rounds without hello answer.
+type availability struct {
+	pub     *publisher
+	limit   int
+	devices map[uint32]*deviceState
+	sync.Mutex
+}
+
+func newAvailability(pub *publisher, limit int) *availability {
+	if limit < 1 {
+		limit = 1
+	}
+	return &availability{pub: pub, limit: limit, devices: make(map[uint32]*deviceState)}
+}
+
+func (a *availability) topic(id uint32) string {
+	return fmt.Sprintf("%s/%x/available", topicPrefix, id)
+}
+
+// seen mark device as online
+func (a *availability) seen(id uint32) {
+	a.Lock()
+	defer a.Unlock()
+
+	s := a.devices[id]
+	if s == nil {
+		s = &deviceState{}
+		a.devices[id] = s
+	}
+	s.misses = 0
+	s.lastSeen = time.Now()
+	if !s.online {
+		s.online = true
+		a.pub.publish(a.topic(id), online, true)
+	}
+}
+
+// missed count device miss, device marked offline when limit reached
+func (a *availability) missed(id uint32) {
+	a.Lock()
+	defer a.Unlock()
+
+	s := a.devices[id]
+	if s == nil {
+		return
+	}
+	a.miss(id, s)
+}
+
+func (a *availability) miss(id uint32, s *deviceState) {
+	s.misses++
+	if s.online && s.misses >= a.limit {
+		s.online = false
+		a.pub.publish(a.topic(id), offline, true)
+	}
+}
+
+// result account result of request to device. Errors answered by device means device is online.
+func (a *availability) result(id uint32, err error) {
+	if err == nil || answered(err) {
+		a.seen(id)
+	} else {
+		a.missed(id)
+	}
+}
+
+// tick count miss for every device not seen during interval, called once per discovery interval
+func (a *availability) tick(interval time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+
+	for id, s := range a.devices {
+		if time.Since(s.lastSeen) > interval {
+			a.miss(id, s)
+		}
+	}
+}
+
+// forget stop tracking device and clean retained availability
+func (a *availability) forget(id uint32) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.devices, id)
+	a.pub.publish(a.topic(id), "", true)
+}
+
+// republish send availability of all devices again, used after mqtt reconnect
+func (a *availability) republish() {
+	a.Lock()
+	defer a.Unlock()
+
+	for id, s := range a.devices {
+		if s.online {
+			a.pub.publish(a.topic(id), online, true)
+		} else {
+			a.pub.publish(a.topic(id), offline, true)
+		}
+	}
+}
+
+// answered return true if error is reported by device itself
+func answered(err error) bool {
+	var re *miio.ResponseError
+	var me *miio.MiotError
+	return errors.As(err, &re) || errors.As(err, &me)
+}
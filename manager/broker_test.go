@@ -0,0 +1,208 @@
+package manager
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// testBroker is minimal mqtt broker on loopback: qos 0 delivery, retained messages and last will
+type testBroker struct {
+	ln       net.Listener
+	clients  map[*brokerClient]bool
+	retained map[string]string
+	connects map[string]int // connections made by client id
+	sync.Mutex
+}
+
+type brokerClient struct {
+	id      string
+	conn    net.Conn
+	filters []string
+	will    *packet.WillMessage
+	sync.Mutex
+}
+
+func startBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, clients: make(map[*brokerClient]bool), retained: make(map[string]string),
+		connects: make(map[string]int)}
+	t.Cleanup(b.close)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&brokerClient{conn: conn})
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.ln.Close()
+	b.Lock()
+	defer b.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+func (b *testBroker) serve(c *brokerClient) {
+	defer c.conn.Close()
+
+	for {
+		pkt, err := packet.ReadPacket(c.conn, false)
+		if err != nil {
+			b.drop(c, true)
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *packet.ConnPacket:
+			c.id, c.will = p.ClientID, p.Will
+			b.Lock()
+			b.clients[c] = true
+			b.connects[c.id]++
+			b.Unlock()
+			c.write(packet.NewConnAck())
+
+		case *packet.SubscribePacket:
+			ack := packet.NewSubAck()
+			ack.Id = p.Id
+			var filters []string
+			for _, topic := range p.Topics {
+				ack.ReturnCodes = append(ack.ReturnCodes, 0)
+				filters = append(filters, topic.Topic)
+			}
+			c.Lock()
+			c.filters = append(c.filters, filters...)
+			c.Unlock()
+			c.write(ack)
+
+			b.Lock()
+			for topic, payload := range b.retained {
+				for _, f := range filters {
+					if topicMatch(f, topic) {
+						c.publish(topic, payload, true)
+						break
+					}
+				}
+			}
+			b.Unlock()
+
+		case *packet.PublishPacket:
+			switch p.QoS {
+			case packet.AtLeastOnce:
+				ack := packet.NewPubAck()
+				ack.Id = p.Id
+				c.write(ack)
+			case packet.ExactlyOnce:
+				rec := packet.NewPubRec()
+				rec.Id = p.Id
+				c.write(rec)
+			}
+			b.publish(p.Topic, p.Payload, p.Retain)
+
+		case *packet.PubRelPacket:
+			comp := packet.NewPubComp()
+			comp.Id = p.Id
+			c.write(comp)
+
+		case *packet.PingPacket:
+			c.write(packet.NewPong())
+
+		case *packet.DisconnectPacket:
+			b.drop(c, false)
+			return
+		}
+	}
+}
+
+// kick break connection of client like lost network does
+func (b *testBroker) kick(id string) {
+	b.Lock()
+	defer b.Unlock()
+	for c := range b.clients {
+		if c.id == id {
+			c.conn.Close()
+		}
+	}
+}
+
+// drop remove client, will message is published if connection is lost without disconnect
+func (b *testBroker) drop(c *brokerClient, lost bool) {
+	b.Lock()
+	_, ok := b.clients[c]
+	delete(b.clients, c)
+	b.Unlock()
+
+	if ok && lost && c.will != nil {
+		b.publish(c.will.Topic, c.will.Payload, c.will.Retain)
+	}
+}
+
+func (b *testBroker) publish(topic string, payload string, retain bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if retain {
+		if payload == "" {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+
+	for c := range b.clients {
+		c.Lock()
+		filters := c.filters
+		c.Unlock()
+		for _, f := range filters {
+			if topicMatch(f, topic) {
+				c.publish(topic, payload, false)
+				break
+			}
+		}
+	}
+}
+
+func (c *brokerClient) publish(topic string, payload string, retain bool) {
+	p := packet.NewPublish()
+	p.Topic = topic
+	p.Payload = payload
+	p.Retain = retain
+	c.write(p)
+}
+
+func (c *brokerClient) write(pkt packet.Packet) {
+	c.Lock()
+	defer c.Unlock()
+	packet.WritePacket(c.conn, pkt, false)
+}
+
+// topicMatch check topic against subscription filter with + and # wildcards
+func topicMatch(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
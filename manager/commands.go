@@ -0,0 +1,145 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"manager_xiaomi/device"
+	"manager_xiaomi/miio"
+	"strconv"
+	"strings"
+)
+
+const (
+	topicPrefix = "xiaomi"
+	cmdSet      = "set"
+	cmdCall     = "call"
+	cmdResult   = "result"
+)
+
+/*
+Command received from mqtt. Topics:
+
+	xiaomi/<id>/call {"id":"1","method":"get_prop","params":["power"]}
+	xiaomi/<id>/set  {"id":"2","prop":"power","value":"on"} (translated to set_power ["on"])
+	xiaomi/<id>/set/<prop> "on" (short form, payload is a json value or plain string)
+
+For miot devices prop is a property name ("light.on") and method can be an action name ("light.toggle").
+
+Answer published to xiaomi/<id>/result with the same correlation id and miio request id used.
+*/
+type Command struct {
+	Id     string      `json:"id,omitempty"`
+	Method string      `json:"method,omitempty"`
+	Params interface{} `json:"params,omitempty"`
+	Prop   string      `json:"prop,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+type CommandResult struct {
+	Id        string          `json:"id,omitempty"`
+	RequestId int             `json:"request_id,omitempty"` // miio request id used for device
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+func (r CommandResult) String() string {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// parseTopic split xiaomi/<id>/<command>[/<prop>] topic. ok is false for topics that aren't commands
+func parseTopic(topic string) (id uint32, cmd string, prop string, ok bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != topicPrefix {
+		return 0, "", "", false
+	}
+
+	switch {
+	case len(parts) == 3 && (parts[2] == cmdSet || parts[2] == cmdCall):
+	case len(parts) == 4 && parts[2] == cmdSet && parts[3] != "":
+		prop = parts[3]
+	default:
+		return 0, "", "", false
+	}
+
+	v, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, "", "", false
+	}
+
+	return uint32(v), parts[2], prop, true
+}
+
+// parseValue decode payload of short set command, not a json payload used as plain string
+func parseValue(payload string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(payload), &v); err != nil {
+		return payload
+	}
+	return v
+}
+
+// execute run command on device and return result to be published. Error returned only if request
+// was sent to device.
+func execute(dev device.Device, cmd string, prop string, payload string) (*CommandResult, error) {
+	var c Command
+	if prop != "" {
+		c.Prop = prop
+		c.Value = parseValue(payload)
+	} else if err := json.Unmarshal([]byte(payload), &c); err != nil {
+		return &CommandResult{Error: "wrong command: " + err.Error()}, nil
+	}
+
+	res := &CommandResult{Id: c.Id}
+	if dev == nil {
+		res.Error = "unknown device"
+		return res, nil
+	}
+
+	var resp *miio.Response
+	var err error
+	switch cmd {
+	case cmdCall:
+		if c.Method == "" {
+			res.Error = "method is not set"
+			return res, nil
+		}
+		resp, err = dev.Call(context.Background(), c.Method, c.Params)
+	case cmdSet:
+		if c.Prop == "" || c.Value == nil {
+			res.Error = "prop or value is not set"
+			return res, nil
+		}
+		resp, err = dev.Set(c.Prop, c.Value)
+	}
+	var re *device.RequestError
+	if resp != nil {
+		res.RequestId = resp.Id
+	} else if errors.As(err, &re) {
+		res.RequestId = re.Id
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	res.Result = resp.Result
+
+	return res, nil
+}
+
+// processCommand run set/call command and answer to result topic
+func processCommand(pub *publisher, avail *availability, dev device.Device, id uint32, cmd string, prop string,
+	payload string) {
+	log.Println("mqtt command", id, cmd, prop, payload)
+	res, err := execute(dev, cmd, prop, payload)
+	if dev != nil && (err != nil || res.Error == "") {
+		avail.result(id, err)
+	}
+	pub.publish(fmt.Sprintf("%s/%x/%s", topicPrefix, id, cmdResult), res.String(), false)
+}
@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"manager_xiaomi/device"
+	"manager_xiaomi/registry"
+	"time"
+)
+
+const (
+	discoveredPrefix = topicPrefix + "/discovered"
+	discoveredEvents = discoveredPrefix + "/events"
+	eventAppeared    = "appeared"
+	eventGone        = "disappeared"
+)
+
+// retained record of present device is republished not more often than this, unless ip, model or token changed
+var discoveredRefresh = time.Minute
+
+// seenDevice is device found by discovery, known or not, published to xiaomi/discovered/<id>
+type seenDevice struct {
+	Id        string    `json:"id"`
+	Ip        string    `json:"ip"`
+	Model     string    `json:"model,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Token     bool      `json:"token"`   // registry has token for device
+	Present   bool      `json:"present"` // false after device is not found for misses discovery rounds
+	published time.Time
+}
+
+// discoveryEvent is published to xiaomi/discovered/events when device appears or disappears
+type discoveryEvent struct {
+	Event string `json:"event"`
+	*seenDevice
+}
+
+// discovered keep every device found by discovery and publish appear and disappear events. It is owned by
+// Run loop.
+type discovered struct {
+	pub     *publisher
+	limit   int
+	devices map[uint32]*seenDevice
+}
+
+func newDiscovered(pub *publisher, limit int) *discovered {
+	if limit < 1 {
+		limit = 1
+	}
+	return &discovered{pub: pub, limit: limit, devices: make(map[uint32]*seenDevice)}
+}
+
+// seen update device reported by discovery. Model is taken from discovery (mdns), registry or previous report.
+func (d *discovered) seen(dev *device.MiIoDevice, reg *registry.Registry) {
+	now := time.Now()
+	s := d.devices[dev.ID()]
+	if s == nil {
+		s = &seenDevice{Id: fmt.Sprintf("%x", dev.ID()), FirstSeen: now}
+		d.devices[dev.ID()] = s
+	}
+
+	model, token := dev.Model(), false
+	if e := reg.Find(s.Id); e != nil {
+		token = e.Token != ""
+		if model == "" {
+			model = e.Model
+		}
+	}
+	if model == "" {
+		model = s.Model
+	}
+
+	appeared := !s.Present
+	changed := appeared || s.Ip != dev.Ip || s.Model != model || s.Token != token
+	s.Ip, s.Model, s.Token, s.Present, s.LastSeen = dev.Ip, model, token, true, now
+
+	if changed || now.Sub(s.published) >= discoveredRefresh {
+		d.publish(s)
+	}
+	if appeared {
+		d.event(eventAppeared, s)
+	}
+}
+
+// tick mark devices not reported for limit discovery intervals as disappeared, called once per interval
+func (d *discovered) tick(interval time.Duration) {
+	for _, s := range d.devices {
+		if s.Present && time.Since(s.LastSeen) > interval*time.Duration(d.limit) {
+			s.Present = false
+			d.publish(s)
+			d.event(eventGone, s)
+		}
+	}
+}
+
+// republish send records of all devices again, used after mqtt reconnect
+func (d *discovered) republish() {
+	for _, s := range d.devices {
+		d.publish(s)
+	}
+}
+
+func (d *discovered) publish(s *seenDevice) {
+	s.published = time.Now()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	d.pub.publish(discoveredPrefix+"/"+s.Id, string(b), true)
+}
+
+func (d *discovered) event(event string, s *seenDevice) {
+	b, err := json.Marshal(discoveryEvent{Event: event, seenDevice: s})
+	if err != nil {
+		return
+	}
+	d.pub.publish(discoveredEvents, string(b), false)
+}
@@ -0,0 +1,202 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"manager_xiaomi/device"
+	"strings"
+)
+
+// home assistant units for miot spec units
+var hassUnits = map[string]string{
+	"celsius":    "°C",
+	"fahrenheit": "°F",
+	"percentage": "%",
+	"watt":       "W",
+	"kWh":        "kWh",
+	"lux":        "lx",
+	"seconds":    "s",
+	"minutes":    "min",
+	"hours":      "h",
+	"days":       "d",
+}
+
+// home assistant device classes for miot property names
+var hassClasses = map[string]string{
+	"temperature":       "temperature",
+	"relative-humidity": "humidity",
+	"electric-power":    "power",
+	"power-consumption": "energy",
+	"illumination":      "illuminance",
+	"pm2.5-density":     "pm25",
+	"pm10-density":      "pm10",
+	"co2-density":       "carbon_dioxide",
+	"battery-level":     "battery",
+}
+
+const hassBool = "{{ 'true' if value_json else 'false' }}"
+
+// hassEntity is one home assistant entity of device, published to <prefix>/<component>/<id>/<object>/config
+type hassEntity struct {
+	component string
+	object    string
+	config    map[string]interface{}
+}
+
+func hassTopic(prefix string, dev device.Device, e hassEntity) string {
+	return fmt.Sprintf("%s/%s/%x/%s/config", prefix, e.component, dev.ID(), e.object)
+}
+
+// hassEntities map device to home assistant entities: bulbs to light, boolean properties to switch
+// (or binary_sensor if read only) and numeric read only properties to sensor.
+// Only published properties are announced.
+func hassEntities(dev device.Device, settings DeviceConfig) []hassEntity {
+	id := fmt.Sprintf("%x", dev.ID())
+	base := fmt.Sprintf("%s/%s", topicPrefix, id)
+	name := settings.Name
+	if name == "" {
+		name = dev.Model() + " " + id
+	}
+	info := map[string]interface{}{
+		"identifiers":  []string{"xiaomi_" + id},
+		"manufacturer": "Xiaomi",
+		"model":        dev.Model(),
+		"name":         name,
+	}
+	if settings.Room != "" {
+		info["suggested_area"] = settings.Room
+	}
+
+	entity := func(component string, prop string, config map[string]interface{}) hassEntity {
+		object := strings.ReplaceAll(prop, ".", "_")
+		config["unique_id"] = "xiaomi_" + id + "_" + object
+		config["object_id"] = "xiaomi_" + id + "_" + object
+		config["device"] = info
+		config["availability"] = []map[string]string{{"topic": statusTopic}, {"topic": base + "/available"}}
+		config["availability_mode"] = "all"
+		if _, ok := config["name"]; !ok {
+			config["name"] = prop
+		}
+		return hassEntity{component: component, object: object, config: config}
+	}
+
+	var res []hassEntity
+
+	if dev.Type() == device.BULB {
+		res = append(res, entity("light", "light", map[string]interface{}{
+			"name":                      name,
+			"command_topic":             base + "/set/power",
+			"state_topic":               base + "/power",
+			"state_value_template":      "{{ value_json }}",
+			"payload_on":                "on",
+			"payload_off":               "off",
+			"brightness_command_topic":  base + "/set/bright",
+			"brightness_state_topic":    base + "/bright",
+			"brightness_value_template": "{{ value_json }}",
+			"brightness_scale":          100,
+		}))
+	}
+
+	m, ok := dev.(*device.MiotDevice)
+	if !ok {
+		return res
+	}
+
+	used := make(map[string]bool)
+	if on := m.Property("light.on"); on != nil && on.Writable() && settings.publishes("light.on") {
+		config := map[string]interface{}{
+			"name":                 name,
+			"command_topic":        base + "/set/light.on",
+			"state_topic":          base + "/light.on",
+			"state_value_template": hassBool,
+			"payload_on":           "true",
+			"payload_off":          "false",
+		}
+		if b := m.Property("light.brightness"); b != nil && b.Readable() && b.Writable() &&
+			settings.publishes("light.brightness") {
+			scale := 100.0
+			if len(b.ValueRange) > 1 {
+				scale = b.ValueRange[1]
+			}
+			config["brightness_command_topic"] = base + "/set/light.brightness"
+			config["brightness_state_topic"] = base + "/light.brightness"
+			config["brightness_value_template"] = "{{ value_json }}"
+			config["brightness_scale"] = scale
+			used["light.brightness"] = true
+		}
+		used["light.on"] = true
+		res = append(res, entity("light", "light", config))
+	}
+
+	for _, prop := range m.Properties() {
+		p := m.Property(prop)
+		if used[prop] || !settings.publishes(prop) {
+			continue
+		}
+
+		switch {
+		case p.Format == "bool" && p.Writable():
+			res = append(res, entity("switch", prop, map[string]interface{}{
+				"command_topic":  base + "/set/" + prop,
+				"state_topic":    base + "/" + prop,
+				"value_template": hassBool,
+				"payload_on":     "true",
+				"payload_off":    "false",
+				"state_on":       "true",
+				"state_off":      "false",
+			}))
+		case p.Format == "bool":
+			res = append(res, entity("binary_sensor", prop, map[string]interface{}{
+				"state_topic":    base + "/" + prop,
+				"value_template": hassBool,
+				"payload_on":     "true",
+				"payload_off":    "false",
+			}))
+		case isNumeric(p.Format) && !p.Writable() && len(p.ValueList) == 0:
+			config := map[string]interface{}{
+				"state_topic":    base + "/" + prop,
+				"value_template": "{{ value_json }}",
+			}
+			if unit, ok := hassUnits[p.Unit]; ok {
+				config["unit_of_measurement"] = unit
+			}
+			if class, ok := hassClasses[p.Name()]; ok {
+				config["device_class"] = class
+				config["state_class"] = "measurement"
+			}
+			res = append(res, entity("sensor", prop, config))
+		}
+	}
+
+	return res
+}
+
+func isNumeric(format string) bool {
+	return format == "float" || strings.HasPrefix(format, "int") || strings.HasPrefix(format, "uint")
+}
+
+// hassAnnounce publish retained discovery configs for device
+func hassAnnounce(prefix string, pub *publisher, dev device.Device, settings DeviceConfig) {
+	if prefix == "" {
+		return
+	}
+
+	for _, e := range hassEntities(dev, settings) {
+		b, err := json.Marshal(e.config)
+		if err != nil {
+			continue
+		}
+		pub.publish(hassTopic(prefix, dev, e), string(b), true)
+	}
+}
+
+// hassRemove clean retained discovery configs, home assistant removes entities on empty config
+func hassRemove(prefix string, pub *publisher, dev device.Device) {
+	if prefix == "" {
+		return
+	}
+
+	for _, e := range hassEntities(dev, DeviceConfig{}) {
+		pub.publish(hassTopic(prefix, dev, e), "", true)
+	}
+}
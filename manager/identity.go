@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"manager_xiaomi/device"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/utils"
+	"strings"
+	"time"
+)
+
+// unknown device id is probed again not earlier than after this interval
+var identifyInterval = time.Minute * 10
+
+// migration is a result of identification: known device came back with the new id
+type migration struct {
+	oldId uint32
+	newId uint32
+	ip    string
+	mac   string
+}
+
+// candidate is a registry entry which device was not found by discovery yet
+type candidate struct {
+	id    uint32
+	model string
+	mac   string
+	token []byte
+}
+
+// DeviceInfo ask miIO.info and return model and mac address of the device
+func DeviceInfo(dev device.Device) (string, string, error) {
+	resp, err := dev.Send("miIO.info", nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	var info miio.Info
+	if err := resp.DecodeResult(&info); err != nil {
+		return "", "", err
+	}
+
+	return info.Model, strings.ToLower(info.Mac), nil
+}
+
+// tokenOwner return migration to unknown device id if token revealed in hello answer belongs to registry device
+func (x *manager) tokenOwner(dev *device.MiIoDevice) *migration {
+	if dev.Token == nil {
+		return nil
+	}
+	e := x.reg.FindByToken(hex.EncodeToString(dev.Token))
+	if e == nil {
+		return nil
+	}
+	return &migration{oldId: utils.ConvertHex(e.Id), newId: dev.ID(), ip: dev.Ip, mac: x.reg.Mac(e.Id)}
+}
+
+// identify try to find registry device for unknown device id. Device is probed with token of every candidate,
+// only the right token gives answer. Mac address (when known) and model should be the same as well.
+// Registry isn't used here, it may be replaced by reload while device is probed.
+func identify(ctx context.Context, debug bool, dev *device.MiIoDevice, candidates []candidate, res chan *migration) {
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return
+		}
+		info, err := device.Probe(debug, dev.ID(), dev.Ip, c.token)
+		if err != nil {
+			continue
+		}
+
+		mac := strings.ToLower(info.Mac)
+		if (c.mac == "" || c.mac == mac) && (c.model == "" || c.model == info.Model) {
+			select {
+			case res <- &migration{oldId: c.id, newId: dev.ID(), ip: dev.Ip, mac: mac}:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+
+	log.Printf("device %x (%s) is unknown", dev.ID(), dev.Ip)
+}
+
+// migrate move known device to the new id in registry and device list, then announce it to mqtt
+func (x *manager) migrate(m *migration) {
+	reg, devices, pub := x.reg, x.devices, x.pub
+	oldId, newId := fmt.Sprintf("%x", m.oldId), fmt.Sprintf("%x", m.newId)
+	if !reg.Rename(oldId, newId) {
+		return
+	}
+	if m.mac != "" {
+		reg.SetMac(newId, m.mac)
+	}
+	if err := reg.Save(); err != nil {
+		log.Println("error save registry", err)
+	}
+	log.Printf("device %s migrated to %s", oldId, newId)
+
+	if old := devices[m.oldId]; old != nil {
+		old.Close()
+		hassRemove(x.cfg.Hass, pub, old)
+	}
+	delete(devices, m.oldId)
+
+	e := reg.Find(newId)
+	dev := device.CreateDevice(x.cfg.Debug, e.Model, e.Id, e.Name, "", e.Token)
+	if dev == nil {
+		return
+	}
+	devices[m.newId] = dev
+
+	payload, _ := json.Marshal(map[string]string{"old": oldId, "new": newId, "mac": m.mac})
+	pub.publish(fmt.Sprintf("%s/%s/migrated", topicPrefix, oldId), string(payload), false)
+}
@@ -0,0 +1,355 @@
+/*
+Package manager connects miio devices from registry to mqtt: discovery, state polling, availability,
+commands and home assistant discovery.
+*/
+package manager
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"manager_xiaomi/device"
+	"manager_xiaomi/discovery"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/mqttclient"
+	"manager_xiaomi/registry"
+	"manager_xiaomi/utils"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+type Config struct {
+	Debug     bool
+	Mqtt      string // mqtt server address
+	ClientId  string
+	KeepAlive int
+	Login     string
+	Pass      string
+	Qos       int
+	Registry  string        // file with known devices and tokens
+	Hass      string        // home assistant discovery prefix, empty to disable
+	Misses    int           // failed requests or discovery rounds to mark device offline
+	Poll      time.Duration // device state poll interval, 0 to disable
+	Reconnect time.Duration // device.ReconnectMax, set by caller before Run
+	QueueWait time.Duration // device.QueueWait, set by caller before Run
+	Discovery discovery.Config
+	Devices   map[string]DeviceConfig // per device settings by hex id
+
+	// Reload return new config on SIGHUP or xiaomi/manager/reload, registry is re-read with current config if nil.
+	// Mqtt, discovery, reconnect and queue wait settings are not changed by reload, changed ones are listed in
+	// reload result as needing restart.
+	Reload func() (Config, error)
+}
+
+// DeviceConfig override registry and global settings for one device
+type DeviceConfig struct {
+	Name  string
+	Room  string        // home assistant area
+	Poll  time.Duration // global poll interval if zero
+	Props []string      // properties published to mqtt, all if empty
+}
+
+// publishes check property should be published to mqtt
+func (c DeviceConfig) publishes(prop string) bool {
+	if len(c.Props) == 0 {
+		return true
+	}
+	for _, p := range c.Props {
+		if p == prop {
+			return true
+		}
+	}
+	return false
+}
+
+// manager keep state of running manager, it is owned by Run loop
+type manager struct {
+	ctx        context.Context
+	cfg        Config
+	pub        *publisher
+	avail      *availability
+	found      *discovered
+	reg        *registry.Registry
+	devices    map[uint32]device.Device
+	pollers    map[uint32]*poller
+	connecting map[uint32]device.Device // devices connected by goroutine, result comes to connects
+	connects   chan *connection
+}
+
+// connection is a result of device connect made outside of Run loop
+type connection struct {
+	dev device.Device
+	mac string // asked only if registry has no mac of device
+	err error
+}
+
+// Run manage devices until ctx is done
+func Run(ctx context.Context, cfg Config) error {
+	reg, err := registry.Load(cfg.Registry)
+	if err != nil {
+		return fmt.Errorf("can't load device registry: %w", err)
+	}
+	device.UseIdStore(reg)
+
+	interval := cfg.Discovery.Interval
+	if interval == 0 {
+		interval = discovery.Interval
+	}
+
+	// connect to mqtt
+	log.Println("try connect to mqtt")
+	will := &packet.WillMessage{Topic: statusTopic, Payload: offline, QoS: 1, Retain: true}
+	mqtt, err := mqttclient.Connect(cfg.Mqtt, cfg.ClientId, uint16(cfg.KeepAlive), false, cfg.Login, cfg.Pass, will,
+		false /* cfg.Debug */)
+	if err != nil {
+		return fmt.Errorf("can't connect to mqtt server: %w", err)
+	}
+
+	x := &manager{
+		ctx:        ctx,
+		cfg:        cfg,
+		reg:        reg,
+		devices:    make(map[uint32]device.Device),
+		pollers:    make(map[uint32]*poller),
+		connecting: make(map[uint32]device.Device),
+		connects:   make(chan *connection),
+	}
+	x.pub = newPublisher(mqtt, cfg.Qos)
+	x.avail = newAvailability(x.pub, cfg.Misses)
+	x.found = newDiscovered(x.pub, cfg.Misses)
+	defer x.stop()
+
+	log.Println("subscribe to managed topics")
+	x.pub.subscribe(topicPrefix + "/#")
+	x.pub.publish(statusTopic, online, true)
+
+	for _, e := range reg.List() {
+		x.createDevice(e)
+	}
+	log.Println("loaded", len(x.devices), "devices from registry")
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	log.Println("start xiaomi discovery")
+	d := make(chan *device.MiIoDevice)
+	if err := discovery.Start(ctx, cfg.Debug, cfg.Discovery, d); err != nil {
+		return fmt.Errorf("can't start discovery: %w", err)
+	}
+
+	migrations := make(chan *migration)
+	probed := make(map[uint32]time.Time)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var rejected miio.Rejected
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-hup:
+			x.reload()
+
+		case <-mqtt.Connected:
+			// session is not persistent, restore subscription and statuses
+			x.pub.subscribe(topicPrefix + "/#")
+			x.pub.publish(statusTopic, online, true)
+			x.avail.republish()
+			x.found.republish()
+
+		case <-ticker.C:
+			x.avail.tick(interval)
+			x.found.tick(interval)
+			if stats := miio.RejectedPackets(); stats != rejected {
+				rejected = stats
+				b, _ := json.Marshal(stats)
+				x.pub.publish(topicPrefix+"/rejected", string(b), true)
+			}
+
+		case pkt := <-mqtt.Receive:
+			if pkt.Type() != packet.PUBLISH {
+				continue
+			}
+			p := pkt.(*packet.PublishPacket)
+			if p.Topic == reloadTopic {
+				x.reload()
+				continue
+			}
+			id, cmd, prop, ok := parseTopic(p.Topic)
+			if !ok {
+				continue
+			}
+			// device queue serialise requests, main loop is not blocked by slow device
+			go processCommand(x.pub, x.avail, x.devices[id], id, cmd, prop, p.Payload)
+
+		case dev := <-d:
+			if dev == nil {
+				continue
+			}
+			x.found.seen(dev, x.reg)
+			if x.devices[dev.ID()] == nil {
+				// unknown device id, may be known device changed id after provisioning
+				id := fmt.Sprintf("%x", dev.ID())
+				if x.reg.Find(id) == nil && time.Now().After(probed[dev.ID()]) {
+					probed[dev.ID()] = time.Now().Add(identifyInterval)
+					if m := x.tokenOwner(dev); m != nil {
+						x.moved(m)
+					} else {
+						go identify(ctx, x.cfg.Debug, dev, x.candidates(), migrations)
+					}
+				}
+				continue
+			}
+			if x.devices[dev.ID()].IP() == "" {
+				x.connectDevice(x.devices[dev.ID()], dev.Ip)
+				continue
+			}
+			// hello answer from known device, it is not online until session is restored by supervisor
+			if x.devices[dev.ID()].Connected() {
+				x.avail.seen(dev.ID())
+			}
+
+		case m := <-migrations:
+			x.moved(m)
+
+		case c := <-x.connects:
+			x.connected(c)
+		}
+	}
+}
+
+// moved stop device by old id and connect it by the new one
+func (x *manager) moved(m *migration) {
+	if p := x.pollers[m.oldId]; p != nil {
+		p.Stop()
+		delete(x.pollers, m.oldId)
+	}
+	x.avail.forget(m.oldId)
+	x.migrate(m)
+	if dev := x.devices[m.newId]; dev != nil {
+		x.connectDevice(dev, m.ip)
+	}
+}
+
+// stop pollers and devices, manager status is published as offline before disconnect
+func (x *manager) stop() {
+	for id, p := range x.pollers {
+		p.Stop()
+		delete(x.pollers, id)
+	}
+	for _, dev := range x.devices {
+		dev.Close()
+	}
+	x.pub.publish(statusTopic, offline, true)
+	x.pub.send(packet.NewDisconnect())
+}
+
+// settings return device config, name is taken from registry if not set
+func (x *manager) settings(id uint32) DeviceConfig {
+	c := x.cfg.Devices[fmt.Sprintf("%x", id)]
+	if c.Name == "" {
+		if e := x.reg.Find(fmt.Sprintf("%x", id)); e != nil {
+			c.Name = e.Name
+		}
+	}
+	return c
+}
+
+// createDevice add registry device to managed devices, it is connected when discovery finds it
+func (x *manager) createDevice(e registry.Entry) device.Device {
+	dev := device.CreateDevice(x.cfg.Debug, e.Model, e.Id, e.Name, "", e.Token)
+	if dev == nil {
+		log.Printf("device %s (%s) is not supported", e.Id, e.Model)
+		return nil
+	}
+	x.devices[dev.ID()] = dev
+	return dev
+}
+
+func (x *manager) startPoller(id uint32) {
+	c := x.settings(id)
+	interval := x.cfg.Poll
+	if c.Poll > 0 {
+		interval = c.Poll
+	}
+	if interval > 0 {
+		x.pollers[id] = startPoller(x.pub, x.avail, x.devices[id], interval, c)
+	}
+}
+
+// connectDevice start communication with discovered device. Handshake and miIO.info are slow for device which
+// doesn't answer, so they are done by goroutine and result is handled by connected in Run loop.
+func (x *manager) connectDevice(dev device.Device, ip string) {
+	if x.connecting[dev.ID()] == dev {
+		return
+	}
+	x.connecting[dev.ID()] = dev
+	log.Println("device", dev)
+
+	// remember mac address to find device when id will be changed, it is kept in registry state file
+	askMac := x.reg.Mac(fmt.Sprintf("%x", dev.ID())) == ""
+	go func(ctx context.Context, res chan *connection) {
+		c := &connection{dev: dev}
+		if c.err = dev.Connect(ip); c.err == nil && askMac {
+			_, c.mac, _ = DeviceInfo(dev)
+		}
+		select {
+		case res <- c:
+		case <-ctx.Done():
+			dev.Close()
+		}
+	}(x.ctx, x.connects)
+}
+
+// connected publish connected device and start its poller. Device removed or replaced by reload or migration
+// while it was connected is closed.
+func (x *manager) connected(c *connection) {
+	id := c.dev.ID()
+	if x.connecting[id] == c.dev {
+		delete(x.connecting, id)
+	}
+	if x.devices[id] != c.dev {
+		c.dev.Close()
+		return
+	}
+	if c.err != nil {
+		log.Println("error connect:", c.err)
+		return
+	}
+
+	if c.mac != "" {
+		x.reg.SetMac(fmt.Sprintf("%x", id), c.mac)
+	}
+
+	payload := c.dev.String()
+	log.Println("payload=", payload)
+	x.pub.publish(fmt.Sprintf("%s/%x", topicPrefix, id), payload, false)
+	hassAnnounce(x.cfg.Hass, x.pub, c.dev, x.settings(id))
+	x.avail.seen(id)
+	x.startPoller(id)
+}
+
+// candidates return registry devices which are not found by discovery yet
+func (x *manager) candidates() []candidate {
+	var res []candidate
+	for _, e := range x.reg.List() {
+		id := utils.ConvertHex(e.Id)
+		if dev := x.devices[id]; dev != nil && dev.IP() != "" {
+			continue
+		}
+		token, err := hex.DecodeString(e.Token)
+		if err != nil || len(token) != 16 {
+			continue
+		}
+		res = append(res, candidate{id: id, model: e.Model, mac: x.reg.Mac(e.Id), token: token})
+	}
+	return res
+}
@@ -0,0 +1,400 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"manager_xiaomi/device"
+	"manager_xiaomi/discovery"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/miio/sim"
+	"manager_xiaomi/mqttclient"
+	"manager_xiaomi/registry"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+var testToken = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+var testSpec = &miio.Details{
+	Type: "urn:miot-spec-v2:device:light:0000A001:sim-light:1",
+	Services: []miio.Service{{
+		Id:   2,
+		Type: "urn:miot-spec-v2:service:light:00007802:sim-light:1",
+		Props: []miio.Property{
+			{Id: 1, Type: "urn:miot-spec-v2:property:on:00000006:sim-light:1", Format: "bool", Access: []string{"read", "write", "notify"}},
+			{Id: 2, Type: "urn:miot-spec-v2:property:brightness:0000000D:sim-light:1", Format: "uint8", Access: []string{"read", "write"}},
+		},
+		Actions: []miio.Action{{Id: 1, Type: "urn:miot-spec-v2:action:toggle:00002811:sim-light:1"}},
+	}},
+}
+
+// watcher is mqtt client which keep last payload of every topic
+type watcher struct {
+	mqtt   *mqttclient.ClientConnection
+	topics map[string]string
+	update chan struct{}
+	sync.Mutex
+}
+
+func startWatcher(t *testing.T, addr string) *watcher {
+	mqtt, err := mqttclient.Connect(addr, "watcher", 30, false, "", "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mqtt.Send <- packet.NewDisconnect() })
+
+	w := &watcher{mqtt: mqtt, topics: make(map[string]string), update: make(chan struct{}, 1)}
+	sp := packet.NewSubscribe()
+	sp.Id = 1
+	sp.Topics = []packet.SubscribePayload{{Topic: "#"}}
+	mqtt.Send <- sp
+
+	go func() {
+		for {
+			select {
+			case pkt := <-mqtt.Receive:
+				p := pkt.(*packet.PublishPacket)
+				w.Lock()
+				w.topics[p.Topic] = p.Payload
+				w.Unlock()
+				select {
+				case w.update <- struct{}{}:
+				default:
+				}
+			case <-mqtt.Done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *watcher) publish(topic string, payload string) {
+	p := packet.NewPublish()
+	p.Topic = topic
+	p.Payload = payload
+	w.mqtt.Send <- p
+}
+
+// wait until topic payload satisfy check
+func (w *watcher) wait(t *testing.T, topic string, check func(string) bool) string {
+	t.Helper()
+	timeout := time.After(time.Second * 10)
+	for {
+		w.Lock()
+		payload, ok := w.topics[topic]
+		w.Unlock()
+		if ok && check(payload) {
+			return payload
+		}
+		select {
+		case <-w.update:
+		case <-time.After(time.Millisecond * 50):
+		case <-timeout:
+			t.Fatalf("no expected message on %s, last %q", topic, payload)
+		}
+	}
+}
+
+func equals(v string) func(string) bool {
+	return func(payload string) bool { return payload == v }
+}
+
+func startSim(t *testing.T, cfg sim.Config) *sim.Device {
+	s, err := sim.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// startManager run manager with registry entries, discovery is sent directly to simulated devices.
+// Registry file path returned.
+func startManager(t *testing.T, addr string, entries []*registry.Entry, targets []string) string {
+	dir := t.TempDir()
+
+	specs := miio.NewSpecStore(filepath.Join(dir, "specs"), "http://127.0.0.1:1")
+	b, _ := json.Marshal(testSpec)
+	os.MkdirAll(filepath.Join(dir, "specs", "model"), 0755)
+	os.WriteFile(filepath.Join(dir, "specs", "model", "sim.light.miot.json"), b, 0644)
+	device.UseSpecs(specs)
+
+	reg, _ := registry.Load(filepath.Join(dir, "devices.json"))
+	for _, e := range entries {
+		reg.Add(e)
+	}
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, Config{
+			Mqtt:      addr,
+			ClientId:  "manager",
+			KeepAlive: 30,
+			Registry:  filepath.Join(dir, "devices.json"),
+			Hass:      "homeassistant",
+			Misses:    3,
+			Poll:      time.Millisecond * 200,
+			Discovery: discovery.Config{
+				Listen:      "127.0.0.1:0",
+				Targets:     targets,
+				NoMulticast: true,
+				Interval:    time.Millisecond * 500,
+			},
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return filepath.Join(dir, "devices.json")
+}
+
+func TestBulb(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	bulb := startSim(t, sim.Config{Id: 0x10001, Token: testToken, Model: "yeelink.light.mono1", Mac: "aa:bb:cc:00:00:01",
+		Addr: "127.0.0.11:54321", Props: map[string]interface{}{"power": "on", "bright": 50}})
+
+	startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "10001", Model: "yeelink.light.mono1", Name: "desk", Token: fmt.Sprintf("%x", testToken)},
+	}, []string{"127.0.0.11"})
+
+	w.wait(t, statusTopic, equals(online))
+
+	// discovery
+	w.wait(t, "xiaomi/10001", func(p string) bool { return strings.Contains(p, `"ip":"127.0.0.11"`) })
+	w.wait(t, "xiaomi/10001/available", equals(online))
+	w.wait(t, "homeassistant/light/10001/light/config", func(p string) bool { return strings.Contains(p, `"name":"desk"`) })
+
+	// state publishing
+	w.wait(t, "xiaomi/10001/power", equals(`"on"`))
+	w.wait(t, "xiaomi/10001/bright", equals(`50`))
+	bulb.SetProp("bright", 70)
+	w.wait(t, "xiaomi/10001/bright", equals(`70`))
+
+	// commands
+	w.publish("xiaomi/10001/set/power", "off")
+	w.wait(t, "xiaomi/10001/result", func(p string) bool { return strings.Contains(p, `"result":["ok"]`) })
+	if bulb.Prop("power") != "off" {
+		t.Fatalf("power is %v", bulb.Prop("power"))
+	}
+	w.wait(t, "xiaomi/10001/power", equals(`"off"`))
+
+	w.publish("xiaomi/10001/call", `{"id":"c1","method":"get_prop","params":["bright"]}`)
+	w.wait(t, "xiaomi/10001/result", func(p string) bool {
+		return strings.Contains(p, `"id":"c1"`) && strings.Contains(p, `"result":[70]`)
+	})
+}
+
+func TestMiot(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	light := startSim(t, sim.Config{Id: 0x10002, Token: testToken, Model: "sim.light.miot", Mac: "aa:bb:cc:00:00:02",
+		Addr: "127.0.0.12:54321", Spec: testSpec})
+
+	startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "10002", Model: "sim.light.miot", Token: fmt.Sprintf("%x", testToken)},
+	}, []string{"127.0.0.12"})
+
+	w.wait(t, "xiaomi/10002/available", equals(online))
+	w.wait(t, "xiaomi/10002/light.on", equals(`false`))
+
+	w.publish("xiaomi/10002/set/light.on", "true")
+	w.wait(t, "xiaomi/10002/light.on", equals(`true`))
+	if light.Property(2, 1) != true {
+		t.Fatalf("light.on is %v", light.Property(2, 1))
+	}
+
+	w.publish("xiaomi/10002/call", `{"id":"a1","method":"light.toggle"}`)
+	w.wait(t, "xiaomi/10002/result", func(p string) bool { return strings.Contains(p, `"id":"a1"`) && !strings.Contains(p, "error") })
+}
+
+func TestOffline(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	bulb := startSim(t, sim.Config{Id: 0x10003, Token: testToken, Model: "yeelink.light.mono1",
+		Addr: "127.0.0.13:54321", Props: map[string]interface{}{"power": "on", "bright": 10}})
+
+	startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "10003", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", testToken)},
+	}, []string{"127.0.0.13"})
+
+	w.wait(t, "xiaomi/10003/available", equals(online))
+
+	// device disappears, failed polls and discovery misses mark it offline
+	bulb.Close()
+	w.wait(t, "xiaomi/10003/available", equals(offline))
+}
+
+func TestReload(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	props := map[string]interface{}{"power": "on", "bright": 10}
+	// every device has own token, otherwise unknown device is identified as registry one
+	tokens := make([][]byte, 3)
+	for i := range tokens {
+		tokens[i] = append([]byte{byte(i)}, testToken[1:]...)
+	}
+	startSim(t, sim.Config{Id: 0x10004, Token: tokens[0], Model: "yeelink.light.mono1", Addr: "127.0.0.14:54321", Props: props})
+	startSim(t, sim.Config{Id: 0x10005, Token: tokens[1], Model: "yeelink.light.mono1", Addr: "127.0.0.15:54321", Props: props})
+	startSim(t, sim.Config{Id: 0x10006, Token: tokens[2], Model: "yeelink.light.mono1", Addr: "127.0.0.16:54321", Props: props})
+
+	path := startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "10004", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", tokens[0])},
+		{Id: "10005", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", tokens[1])},
+	}, []string{"127.0.0.14", "127.0.0.15", "127.0.0.16"})
+
+	w.wait(t, "xiaomi/10004/available", equals(online))
+	w.wait(t, "xiaomi/10005/available", equals(online))
+	w.wait(t, "homeassistant/light/10004/light/config", func(p string) bool { return p != "" })
+
+	reg, err := registry.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Remove("10004")
+	reg.Add(&registry.Entry{Id: "10006", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", tokens[2])})
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	w.publish(reloadTopic, "")
+	w.wait(t, reloadResultTopic, equals(`{"added":["10006"],"removed":["10004"]}`))
+	w.wait(t, "xiaomi/10006/available", equals(online))
+	w.wait(t, "homeassistant/light/10004/light/config", equals(""))
+	w.wait(t, "xiaomi/10005/available", equals(online))
+}
+
+func TestDiscovered(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	props := map[string]interface{}{"power": "on", "bright": 10}
+	other := append([]byte{0xff}, testToken[1:]...)
+	startSim(t, sim.Config{Id: 0x10007, Token: testToken, Model: "yeelink.light.mono1", Addr: "127.0.0.17:54321", Props: props})
+	unknown := startSim(t, sim.Config{Id: 0x10008, Token: other, Model: "yeelink.light.mono1", Addr: "127.0.0.18:54321", Props: props})
+
+	startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "10007", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", testToken)},
+	}, []string{"127.0.0.17", "127.0.0.18"})
+
+	w.wait(t, discoveredPrefix+"/10007", func(p string) bool {
+		return strings.Contains(p, `"ip":"127.0.0.17","model":"yeelink.light.mono1"`) &&
+			strings.Contains(p, `"token":true,"present":true`)
+	})
+	w.wait(t, discoveredPrefix+"/10008", func(p string) bool {
+		return strings.Contains(p, `"ip":"127.0.0.18","first_seen"`) && strings.Contains(p, `"token":false,"present":true`)
+	})
+
+	// unknown device goes away, record is kept retained
+	unknown.Close()
+	w.wait(t, discoveredEvents, func(p string) bool {
+		return strings.Contains(p, `"event":"disappeared","id":"10008"`) && strings.Contains(p, `"present":false`)
+	})
+	w.wait(t, discoveredPrefix+"/10008", func(p string) bool { return strings.Contains(p, `"present":false`) })
+}
+
+func TestMigration(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+
+	// device is provisioned again and comes back with the new id, token and mac are the same
+	startSim(t, sim.Config{Id: 0x1000a, Token: testToken, Model: "yeelink.light.mono1", Mac: "aa:bb:cc:00:00:09",
+		Addr: "127.0.0.19:54321", Props: map[string]interface{}{"power": "on", "bright": 10}})
+	path := startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "10009", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", testToken), Mac: "aa:bb:cc:00:00:09"},
+	}, []string{"127.0.0.19"})
+
+	w.wait(t, "xiaomi/10009/migrated", func(p string) bool {
+		return p == `{"mac":"aa:bb:cc:00:00:09","new":"1000a","old":"10009"}`
+	})
+	w.wait(t, "xiaomi/1000a", func(p string) bool { return strings.Contains(p, `"ip":"127.0.0.19"`) })
+	w.wait(t, "xiaomi/1000a/power", equals(`"on"`))
+
+	reg, err := registry.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := reg.Find("1000a"); e == nil || e.Token != fmt.Sprintf("%x", testToken) || reg.Find("10009") != nil {
+		t.Fatalf("registry entry is not renamed %+v", reg.List())
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	reg, _ := registry.Load(path)
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{Registry: path, Misses: 3, Reconnect: time.Minute, Discovery: discovery.Config{Targets: []string{"10.0.0.1"}}}
+	next := cfg
+	next.Misses = 5
+	next.Reconnect = time.Second * 10
+	next.QueueWait = time.Second
+	cfg.Reload = func() (Config, error) { return next, nil }
+
+	x := &manager{cfg: cfg, reg: reg, devices: make(map[uint32]device.Device), pollers: make(map[uint32]*poller)}
+	x.avail = newAvailability(nil, cfg.Misses)
+	x.found = newDiscovered(nil, cfg.Misses)
+
+	// misses is applied, session settings are kept and reported
+	res := x.apply()
+	if res.Error != "" || strings.Join(res.Restart, ",") != "reconnect,queue_wait" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if x.cfg.Misses != 5 || x.cfg.Reconnect != time.Minute || x.cfg.QueueWait != 0 || x.avail.limit != 5 {
+		t.Fatalf("unexpected config %+v", x.cfg)
+	}
+}
+
+func TestMqttReconnect(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	startManager(t, broker.addr(), nil, nil)
+	w.wait(t, statusTopic, equals(online))
+
+	// broken connection gives will message, manager connects again and restores status
+	broker.kick("manager")
+	w.wait(t, statusTopic, func(p string) bool {
+		broker.Lock()
+		defer broker.Unlock()
+		return p == online && broker.connects["manager"] == 2
+	})
+}
+
+func TestSlowConnect(t *testing.T) {
+	broker := startBroker(t)
+	w := startWatcher(t, broker.addr())
+	// slow device is asked for mac when connected, manager loop is not blocked meanwhile
+	slow := startSim(t, sim.Config{Id: 0x1000b, Token: testToken, Model: "yeelink.light.mono1", Addr: "127.0.0.26:54321",
+		Props: map[string]interface{}{"power": "on", "bright": 10}})
+	slow.SetFaults(sim.Faults{Delay: time.Millisecond * 2500})
+	startManager(t, broker.addr(), []*registry.Entry{
+		{Id: "1000b", Model: "yeelink.light.mono1", Token: fmt.Sprintf("%x", testToken)},
+	}, []string{"127.0.0.26"})
+
+	w.wait(t, discoveredPrefix+"/1000b", func(p string) bool { return strings.Contains(p, `"present":true`) })
+	start := time.Now()
+	w.publish(reloadTopic, "")
+	w.wait(t, reloadResultTopic, equals(`{}`))
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("reload is handled after %s", d)
+	}
+
+	slow.SetFaults(sim.Faults{})
+	w.wait(t, "xiaomi/1000b/available", equals(online))
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"manager_xiaomi/device"
+	"time"
+)
+
+// poller periodically read device state and publish changed properties to xiaomi/<id>/<prop>
+type poller struct {
+	pub      *publisher
+	avail    *availability
+	dev      device.Device
+	interval time.Duration
+	settings DeviceConfig
+	last     map[string]string
+	stop     chan bool
+}
+
+func startPoller(pub *publisher, avail *availability, dev device.Device, interval time.Duration,
+	settings DeviceConfig) *poller {
+	p := &poller{
+		pub:      pub,
+		avail:    avail,
+		dev:      dev,
+		interval: interval,
+		settings: settings,
+		last:     make(map[string]string),
+		stop:     make(chan bool),
+	}
+	go p.run()
+	return p
+}
+
+func (p *poller) Stop() {
+	close(p.stop)
+}
+
+func (p *poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	p.poll()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.poll()
+		}
+	}
+}
+
+func (p *poller) poll() {
+	state, err := p.dev.State()
+	p.avail.result(p.dev.ID(), err)
+	if err != nil {
+		log.Printf("error poll device %x: %s", p.dev.ID(), err)
+		return
+	}
+
+	for prop, value := range state {
+		if !p.settings.publishes(prop) {
+			continue
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		if last, ok := p.last[prop]; ok && last == string(b) {
+			continue
+		}
+		p.last[prop] = string(b)
+		p.pub.publish(fmt.Sprintf("%s/%x/%s", topicPrefix, p.dev.ID(), prop), string(b), true)
+	}
+}
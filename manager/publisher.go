@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"github.com/MajaSuite/mqtt/packet"
+	"manager_xiaomi/mqttclient"
+	"sync"
+)
+
+// publisher serialize access to mqtt connection and message id counter
+type publisher struct {
+	mqtt *mqttclient.ClientConnection
+	qos  packet.QoS
+	id   uint16
+	sync.Mutex
+}
+
+func newPublisher(mqtt *mqttclient.ClientConnection, qos int) *publisher {
+	return &publisher{mqtt: mqtt, qos: packet.QoS(qos), id: 1}
+}
+
+func (p *publisher) nextId() uint16 {
+	p.Lock()
+	defer p.Unlock()
+	id := p.id
+	p.id++
+	if p.id == 0 {
+		p.id = 1
+	}
+	return id
+}
+
+func (p *publisher) subscribe(topic string) {
+	sp := packet.NewSubscribe()
+	sp.Id = p.nextId()
+	sp.Topics = []packet.SubscribePayload{{Topic: topic, QoS: 1}}
+	p.send(sp)
+}
+
+func (p *publisher) publish(topic string, payload string, retain bool) {
+	pp := packet.NewPublish()
+	pp.Id = p.nextId()
+	pp.Topic = topic
+	pp.QoS = p.qos
+	pp.Retain = retain
+	pp.Payload = payload
+	p.send(pp)
+}
+
+// send pass packet to mqtt connection, packets are dropped after disconnect
+func (p *publisher) send(pkt packet.Packet) {
+	select {
+	case p.mqtt.Send <- pkt:
+	case <-p.mqtt.Done:
+	}
+}
@@ -0,0 +1,170 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"manager_xiaomi/device"
+	"manager_xiaomi/registry"
+	"manager_xiaomi/utils"
+	"reflect"
+	"sort"
+)
+
+const (
+	reloadTopic       = topicPrefix + "/manager/reload"
+	reloadResultTopic = topicPrefix + "/manager/result"
+)
+
+// ReloadResult published to xiaomi/manager/result after reload, device ids are hex
+type ReloadResult struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"` // recreated after model, token or name change
+	Updated []string `json:"updated,omitempty"` // poller and home assistant configs restarted with new settings
+	Restart []string `json:"restart,omitempty"` // changed settings applied after restart only
+	Error   string   `json:"error,omitempty"`
+}
+
+// reload re-read config and registry and restart only devices changed. Sessions and pollers of other
+// devices are kept running.
+func (x *manager) reload() {
+	log.Println("reload config and registry")
+	res := x.apply()
+	if res.Error != "" {
+		log.Println("error reload:", res.Error)
+	}
+	b, _ := json.Marshal(res)
+	x.pub.publish(reloadResultTopic, string(b), false)
+}
+
+func (x *manager) apply() *ReloadResult {
+	cfg := x.cfg
+	var restart []string
+	if x.cfg.Reload != nil {
+		c, err := x.cfg.Reload()
+		if err != nil {
+			return &ReloadResult{Error: err.Error()}
+		}
+		restart = restartOnly(cfg, c)
+		if len(restart) > 0 {
+			log.Printf("settings %v are changed after restart only", restart)
+		}
+		c.Mqtt, c.ClientId, c.KeepAlive, c.Login, c.Pass, c.Qos = cfg.Mqtt, cfg.ClientId, cfg.KeepAlive, cfg.Login,
+			cfg.Pass, cfg.Qos
+		c.Discovery = cfg.Discovery
+		c.Reconnect, c.QueueWait = cfg.Reconnect, cfg.QueueWait
+		c.Reload = cfg.Reload
+		cfg = c
+	}
+
+	reg, err := registry.Load(cfg.Registry)
+	if err != nil {
+		return &ReloadResult{Error: fmt.Sprintf("can't load device registry: %s", err)}
+	}
+
+	oldCfg := x.cfg
+	old := make(map[string]registry.Entry)
+	for _, e := range x.reg.List() {
+		old[e.Id] = e
+	}
+	oldSettings := make(map[uint32]DeviceConfig)
+	for id := range x.devices {
+		oldSettings[id] = x.settings(id)
+	}
+
+	x.cfg = cfg
+	x.reg = reg
+	device.UseIdStore(reg)
+	x.avail.Lock()
+	x.avail.limit = cfg.Misses
+	x.avail.Unlock()
+	x.found.limit = cfg.Misses
+
+	res := &ReloadResult{Restart: restart}
+	fresh := make(map[string]bool)
+	for _, e := range reg.List() {
+		fresh[e.Id] = true
+		o, ok := old[e.Id]
+		switch {
+		case !ok:
+			x.createDevice(e)
+			res.Added = append(res.Added, e.Id)
+		case o.Model != e.Model || o.Token != e.Token || o.Name != e.Name:
+			ip := x.stopDevice(utils.ConvertHex(e.Id), oldCfg.Hass)
+			if dev := x.createDevice(e); dev != nil && ip != "" {
+				x.connectDevice(dev, ip)
+			}
+			res.Changed = append(res.Changed, e.Id)
+		default:
+			id := utils.ConvertHex(e.Id)
+			dev := x.devices[id]
+			if dev == nil || reflect.DeepEqual(oldSettings[id], x.settings(id)) && oldCfg.Poll == cfg.Poll &&
+				oldCfg.Hass == cfg.Hass {
+				continue
+			}
+			if p := x.pollers[id]; p != nil {
+				p.Stop()
+				delete(x.pollers, id)
+			}
+			if dev.IP() != "" {
+				if oldCfg.Hass != cfg.Hass {
+					hassRemove(oldCfg.Hass, x.pub, dev)
+				}
+				hassAnnounce(cfg.Hass, x.pub, dev, x.settings(id))
+				x.startPoller(id)
+			}
+			res.Updated = append(res.Updated, e.Id)
+		}
+	}
+
+	for id := range old {
+		if !fresh[id] {
+			x.stopDevice(utils.ConvertHex(id), oldCfg.Hass)
+			res.Removed = append(res.Removed, id)
+		}
+	}
+
+	sort.Strings(res.Removed)
+	log.Printf("reload: added %v, removed %v, changed %v, updated %v", res.Added, res.Removed, res.Changed, res.Updated)
+	return res
+}
+
+// restartOnly return names of settings changed in new config which are not applied by reload. Mqtt
+// connection and discovery socket are opened once, session restore settings are read by running devices.
+func restartOnly(old Config, c Config) []string {
+	var res []string
+	if c.Mqtt != old.Mqtt || c.ClientId != old.ClientId || c.KeepAlive != old.KeepAlive || c.Login != old.Login ||
+		c.Pass != old.Pass || c.Qos != old.Qos {
+		res = append(res, "mqtt")
+	}
+	if !reflect.DeepEqual(c.Discovery, old.Discovery) {
+		res = append(res, "discovery")
+	}
+	if c.Reconnect != old.Reconnect {
+		res = append(res, "reconnect")
+	}
+	if c.QueueWait != old.QueueWait {
+		res = append(res, "queue_wait")
+	}
+	return res
+}
+
+// stopDevice stop poller, close session and remove home assistant configs of device. Last device ip returned.
+func (x *manager) stopDevice(id uint32, hass string) string {
+	if p := x.pollers[id]; p != nil {
+		p.Stop()
+		delete(x.pollers, id)
+	}
+	x.avail.forget(id)
+
+	dev := x.devices[id]
+	if dev == nil {
+		return ""
+	}
+	ip := dev.IP()
+	dev.Close()
+	hassRemove(hass, x.pub, dev)
+	delete(x.devices, id)
+	return ip
+}
@@ -0,0 +1,78 @@
+package miio
+
+import (
+	"errors"
+	"manager_xiaomi/utils"
+	"sync"
+)
+
+const (
+	headerSize = 0x20
+	// packet length is uint16, datagram can't be longer
+	MaxPacketSize = 0xffff
+)
+
+var (
+	ErrTruncatedPacket = errors.New("packet is shorter than its length")
+	ErrOversizedPacket = errors.New("packet is longer than its length")
+	ErrShortPacket     = errors.New("packet is shorter than header")
+)
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, MaxPacketSize)
+		return &buf
+	},
+}
+
+// GetBuffer return buffer to read one datagram, it should be returned with PutBuffer
+func GetBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func PutBuffer(buf *[]byte) {
+	if cap(*buf) >= MaxPacketSize {
+		*buf = (*buf)[:MaxPacketSize]
+		buffers.Put(buf)
+	}
+}
+
+// CheckFrame validate that datagram contains exactly one packet: magic is right and
+// header Length equals datagram size.
+func CheckFrame(buf []byte) error {
+	err := checkFrame(buf)
+	if err != nil {
+		countReject(&rejected.frame)
+	}
+	return err
+}
+
+func checkFrame(buf []byte) error {
+	if len(buf) < headerSize {
+		return ErrShortPacket
+	}
+
+	magic, offset, _ := utils.ReadInt16(buf, 0)
+	if magic != 0x2131 {
+		return ErrWrongPacket
+	}
+
+	length, _, _ := utils.ReadInt16(buf, offset)
+	switch {
+	case int(length) < headerSize:
+		return ErrInvalidPacketLength
+	case int(length) > len(buf):
+		return ErrTruncatedPacket
+	case int(length) < len(buf):
+		return ErrOversizedPacket
+	}
+
+	return nil
+}
+
+// IsFrameError return true for errors of CheckFrame. Such datagrams should be dropped,
+// connection is still fine.
+func IsFrameError(err error) bool {
+	return err == ErrShortPacket || err == ErrWrongPacket || err == ErrInvalidPacketLength ||
+		err == ErrTruncatedPacket || err == ErrOversizedPacket
+}
@@ -0,0 +1,46 @@
+package miio
+
+import "testing"
+
+func TestCheckFrame(t *testing.T) {
+	valid := fuzzPacket(t, []byte(`{"id":1,"result":["ok"]}`))
+	// length field of packet changed by delta
+	length := func(delta int) []byte {
+		buf := append([]byte(nil), valid...)
+		n := len(buf) + delta
+		buf[2], buf[3] = byte(n>>8), byte(n)
+		return buf
+	}
+	max := make([]byte, MaxPacketSize)
+	copy(max, valid)
+	max[2], max[3] = 0xff, 0xff
+
+	for name, c := range map[string]struct {
+		buf []byte
+		err error
+	}{
+		"valid":        {valid, nil},
+		"hello":        {fuzzHello(t), nil},
+		"largest":      {max, nil},
+		"truncated":    {valid[:len(valid)-1], ErrTruncatedPacket},
+		"oversized":    {append(append([]byte(nil), valid...), 0), ErrOversizedPacket},
+		"empty":        {nil, ErrShortPacket},
+		"short header": {valid[:headerSize-1], ErrShortPacket},
+		"long length":  {length(16), ErrTruncatedPacket},
+		"short length": {length(-16), ErrOversizedPacket},
+		"tiny length":  {length(headerSize - 1 - len(valid)), ErrInvalidPacketLength},
+		"wrong magic":  {append([]byte{0x31, 0x21}, valid[2:]...), ErrWrongPacket},
+	} {
+		err := CheckFrame(c.buf)
+		if err != c.err {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if err != nil && !IsFrameError(err) {
+			t.Errorf("%s: %v is not frame error", name, err)
+		}
+	}
+
+	if IsFrameError(ErrChecksumMismatch) || IsFrameError(nil) {
+		t.Fatal("packet errors are taken for frame errors")
+	}
+}
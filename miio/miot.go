@@ -0,0 +1,96 @@
+package miio
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+MIoT devices use generic methods with siid/piid/aiid addressing instead of per model methods:
+	"get_properties", []PropRef{{Did:"1",Siid:2,Piid:1}}
+	"set_properties", []PropValue{{Did:"1",Siid:2,Piid:1,Value:true}}
+	"action", &ActionRequest{Did:"1",Siid:2,Aiid:1,In:[]interface{}{}}
+Every item of result has own code, negative code means error.
+*/
+
+// PropRef address one property of miot device
+type PropRef struct {
+	Did  string `json:"did"`
+	Siid int    `json:"siid"`
+	Piid int    `json:"piid"`
+}
+
+// PropValue is a property with value to set
+type PropValue struct {
+	Did   string      `json:"did"`
+	Siid  int         `json:"siid"`
+	Piid  int         `json:"piid"`
+	Value interface{} `json:"value"`
+}
+
+// PropResult is an answer for one property of get_properties/set_properties request
+type PropResult struct {
+	Did   string          `json:"did"`
+	Siid  int             `json:"siid"`
+	Piid  int             `json:"piid"`
+	Code  int             `json:"code"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Err return *MiotError if device failed to process property
+func (r PropResult) Err() error {
+	if r.Code < 0 {
+		return &MiotError{Siid: r.Siid, Piid: r.Piid, Code: r.Code}
+	}
+	return nil
+}
+
+// DecodeValue unmarshal property value into v
+func (r PropResult) DecodeValue(v interface{}) error {
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if len(r.Value) == 0 {
+		return ErrEmptyResponse
+	}
+	return json.Unmarshal(r.Value, v)
+}
+
+// method = "action"
+type ActionRequest struct {
+	Did  string        `json:"did"`
+	Siid int           `json:"siid"`
+	Aiid int           `json:"aiid"`
+	In   []interface{} `json:"in"`
+}
+
+type ActionResult struct {
+	Did  string            `json:"did,omitempty"`
+	Siid int               `json:"siid,omitempty"`
+	Aiid int               `json:"aiid,omitempty"`
+	Code int               `json:"code"`
+	Out  []json.RawMessage `json:"out,omitempty"`
+}
+
+// Err return *MiotError if device failed to run action
+func (r ActionResult) Err() error {
+	if r.Code < 0 {
+		return &MiotError{Siid: r.Siid, Aiid: r.Aiid, Code: r.Code}
+	}
+	return nil
+}
+
+// MiotError is an error code returned for property or action
+type MiotError struct {
+	Siid int
+	Piid int
+	Aiid int
+	Code int
+}
+
+func (e MiotError) Error() string {
+	if e.Aiid != 0 {
+		return fmt.Sprintf("miot action siid %d aiid %d error %d", e.Siid, e.Aiid, e.Code)
+	}
+	return fmt.Sprintf("miot property siid %d piid %d error %d", e.Siid, e.Piid, e.Code)
+}
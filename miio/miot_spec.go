@@ -2,14 +2,7 @@ package miio
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
-)
-
-const (
-	urlAll string = "http://miot-spec.org/miot-spec-v2/instances?status=all"
-	// get parameter should be taken from field 'type' Instance structure
-	urlDetails string = "http://miot-spec.org/miot-spec-v2/instance?type="
+	"strings"
 )
 
 type Instance struct {
@@ -23,24 +16,26 @@ type Instances struct {
 	Instances []Instance `json:"instances"`
 }
 
+// GetInstances download list of all spec instances from miot-spec.org
 func GetInstances() (*Instances, error) {
-	response, err := http.Get(urlAll)
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-
-	jsonResponse, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
+	return NewSpecStore("", DefaultSpecURL).Instances()
+}
 
-	var i *Instances
-	if err := json.Unmarshal(jsonResponse, &i); err != nil {
-		return nil, err
+// Find return latest released instance for model (or latest one if nothing released)
+func (i *Instances) Find(model string) *Instance {
+	var res *Instance
+	for n := range i.Instances {
+		inst := &i.Instances[n]
+		if inst.Model != model {
+			continue
+		}
+		if res == nil ||
+			(inst.Status == "released" && res.Status != "released") ||
+			(inst.Status == res.Status && inst.Version > res.Version) {
+			res = inst
+		}
 	}
-
-	return i, nil
+	return res
 }
 
 func (i *Instances) String() string {
@@ -57,25 +52,9 @@ type Details struct {
 	Services []Service `json:"services"`
 }
 
+// GetDetail download spec by urn, it should be taken from field 'type' of Instance structure
 func GetDetail(urn string) (*Details, error) {
-	var url string = urlDetails + urn
-	response, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-
-	res, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var detail *Details
-	if err := json.Unmarshal(res, &detail); err != nil {
-		return nil, err
-	}
-
-	return detail, nil
+	return NewSpecStore("", DefaultSpecURL).Detail(urn)
 }
 
 func (a *Details) String() string {
@@ -87,10 +66,16 @@ func (a *Details) String() string {
 }
 
 type Service struct {
-	Id    int        `json:"id"`
-	Type  string     `json:"type"`
-	Desc  string     `json:"description"`
-	Props []Property `json:"properties"`
+	Id      int        `json:"iid"`
+	Type    string     `json:"type"`
+	Desc    string     `json:"description"`
+	Props   []Property `json:"properties"`
+	Actions []Action   `json:"actions,omitempty"`
+}
+
+// Name return short name from urn, e.g. "light" for "urn:miot-spec-v2:service:light:00007802:yeelink-color1:1"
+func (a *Service) Name() string {
+	return urnName(a.Type)
 }
 
 func (a *Service) String() string {
@@ -102,11 +87,45 @@ func (a *Service) String() string {
 }
 
 type Property struct {
-	Id     int      `json:"id"`
-	Type   string   `json:"type"`
-	Desc   string   `json:"description"`
-	Format string   `json:"format"`
-	Access []string `json:"access"`
+	Id         int         `json:"iid"`
+	Type       string      `json:"type"`
+	Desc       string      `json:"description"`
+	Format     string      `json:"format"`
+	Access     []string    `json:"access"`
+	Unit       string      `json:"unit,omitempty"`
+	ValueRange []float64   `json:"value-range,omitempty"`
+	ValueList  []ValueItem `json:"value-list,omitempty"`
+}
+
+type ValueItem struct {
+	Value int    `json:"value"`
+	Desc  string `json:"description"`
+}
+
+// Name return short name from urn, e.g. "on" for "urn:miot-spec-v2:property:on:00000006:yeelink-color1:1"
+func (a *Property) Name() string {
+	return urnName(a.Type)
+}
+
+func (a *Property) Readable() bool {
+	return a.hasAccess("read")
+}
+
+func (a *Property) Writable() bool {
+	return a.hasAccess("write")
+}
+
+func (a *Property) Notify() bool {
+	return a.hasAccess("notify")
+}
+
+func (a *Property) hasAccess(access string) bool {
+	for _, v := range a.Access {
+		if v == access {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *Property) String() string {
@@ -116,3 +135,32 @@ func (a *Property) String() string {
 	}
 	return string(b)
 }
+
+type Action struct {
+	Id   int    `json:"iid"`
+	Type string `json:"type"`
+	Desc string `json:"description"`
+	In   []int  `json:"in"`
+	Out  []int  `json:"out"`
+}
+
+// Name return short name from urn, e.g. "toggle" for "urn:miot-spec-v2:action:toggle:00002811:yeelink-color1:1"
+func (a *Action) Name() string {
+	return urnName(a.Type)
+}
+
+func (a *Action) String() string {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func urnName(urn string) string {
+	parts := strings.Split(urn, ":")
+	if len(parts) < 4 {
+		return urn
+	}
+	return parts[3]
+}
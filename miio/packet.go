@@ -19,6 +19,11 @@ var (
 	ErrInvalidPacketLength = errors.New("invalid packet Len")
 	ErrUnknownPacket       = errors.New("unknown packet type")
 	ErrWrongPacket         = errors.New("Wrong packet, magic is illegal")
+	ErrChecksumMismatch    = errors.New("packet checksum mismatch")
+	ErrDeviceIdMismatch    = errors.New("packet from unexpected device")
+
+	// VerifyChecksum enables checksum check of packets received from devices with known token
+	VerifyChecksum = true
 )
 
 type Packet struct {
@@ -82,6 +87,8 @@ func NewPacket(deviceId uint32, deviceToken []byte, timestamp uint32, payload []
 	return packet, nil
 }
 
+// ParsePacket unpack and decrypt packet. If token is set packet checksum and device id are verified,
+// forged packets rejected with ErrChecksumMismatch or ErrDeviceIdMismatch.
 func ParsePacket(deviceId uint32, deviceToken []byte, buf []byte) (*Packet, error) {
 	packet := &Packet{
 		DeviceId:    deviceId,
@@ -94,6 +101,16 @@ func ParsePacket(deviceId uint32, deviceToken []byte, buf []byte) (*Packet, erro
 	}
 
 	if deviceToken != nil {
+		if deviceId != 0 && deviceId != HelloPacketDeviceId && packet.DeviceId != deviceId {
+			countReject(&rejected.deviceId)
+			return nil, ErrDeviceIdMismatch
+		}
+
+		if VerifyChecksum && !bytes.Equal(packet.CalculateChecksum(buf[:16]), packet.CheckSum) {
+			countReject(&rejected.checksum)
+			return nil, ErrChecksumMismatch
+		}
+
 		hash := md5.New()
 		_, err = hash.Write(deviceToken)
 		if err != nil {
@@ -114,6 +131,7 @@ func ParsePacket(deviceId uint32, deviceToken []byte, buf []byte) (*Packet, erro
 
 		packet.Data, err = packet.Decrypt()
 		if err != nil {
+			countReject(&rejected.decrypt)
 			return nil, err
 		}
 	}
@@ -121,6 +139,17 @@ func ParsePacket(deviceId uint32, deviceToken []byte, buf []byte) (*Packet, erro
 	return packet, nil
 }
 
+// Token return device token revealed in hello answer. Provisioned devices hide token
+// and fill checksum with 0xff or 0x00 bytes, nil returned in this case.
+func (p *Packet) Token() []byte {
+	if len(p.CheckSum) != 16 ||
+		bytes.Equal(p.CheckSum, bytes.Repeat([]byte{0xff}, 16)) ||
+		bytes.Equal(p.CheckSum, make([]byte, 16)) {
+		return nil
+	}
+	return append([]byte(nil), p.CheckSum...)
+}
+
 func (p *Packet) pkcs5Pad(data []byte, blockSize int) []byte {
 	length := len(data)
 	padLength := (blockSize - (length % blockSize))
@@ -130,10 +159,19 @@ func (p *Packet) pkcs5Pad(data []byte, blockSize int) []byte {
 
 func (p *Packet) pkcs5Unpad(data []byte, blockSize int) ([]byte, error) {
 	srcLen := len(data)
+	if srcLen == 0 || srcLen%blockSize != 0 {
+		return nil, ErrPadding
+	}
+
 	paddingLen := int(data[srcLen-1])
-	if paddingLen >= srcLen || paddingLen > blockSize {
+	if paddingLen == 0 || paddingLen > srcLen || paddingLen > blockSize {
 		return nil, ErrPadding
 	}
+	for _, b := range data[srcLen-paddingLen:] {
+		if int(b) != paddingLen {
+			return nil, ErrPadding
+		}
+	}
 	return data[:srcLen-paddingLen], nil
 }
 
@@ -160,13 +198,14 @@ func (p *Packet) Pack() ([]byte, error) {
 	return buf, nil
 }
 
-func (p *Packet) CalculateChecksum(buf []byte) []byte {
+// CalculateChecksum return md5 of 16 bytes header, token and payload
+func (p *Packet) CalculateChecksum(header []byte) []byte {
 	hash := md5.New()
 
-	b := append(buf, p.DeviceToken...)
-	b = append(b, p.Data...)
+	hash.Write(header)
+	hash.Write(p.DeviceToken)
+	hash.Write(p.Data)
 
-	hash.Write(b)
 	return hash.Sum(nil)
 }
 
@@ -196,7 +235,11 @@ func (p *Packet) Unpack(buf []byte) error {
 		return err
 	}
 
-	if p.Length-0x20 > 0 {
+	// length includes header, uint16 must not underflow
+	if p.Length < 0x20 {
+		return ErrInvalidPacketLength
+	}
+	if p.Length > 0x20 {
 		if p.Data, offset, err = utils.ReadBytes(buf, offset, int(p.Length)-0x20); err != nil {
 			return err
 		}
@@ -215,6 +258,11 @@ func (p *Packet) Decrypt() ([]byte, error) {
 		return nil, err
 	}
 
+	// CryptBlocks panics on partial block
+	if len(p.Data) == 0 || len(p.Data)%block.BlockSize() != 0 {
+		return nil, ErrPadding
+	}
+
 	stream := cipher.NewCBCDecrypter(block, p.iv)
 	decrypted := make([]byte, len(p.Data))
 	stream.CryptBlocks(decrypted, p.Data)
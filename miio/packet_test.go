@@ -0,0 +1,170 @@
+package miio
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzToken = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+func fuzzPacket(t testing.TB, payload []byte) []byte {
+	p, err := NewPacket(0x1234, fuzzToken, 100, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func fuzzHello(t testing.TB) []byte {
+	p, err := NewPacket(HelloPacketDeviceId, nil, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func FuzzParsePacket(f *testing.F) {
+	f.Add(fuzzPacket(f, []byte(`{"id":1,"result":["ok"]}`)))
+	f.Add(fuzzHello(f))
+	f.Add([]byte{0x21, 0x31, 0x00, 0x10})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		pkt, err := ParsePacket(0x1234, fuzzToken, buf)
+		if err == nil && pkt.DeviceId != 0x1234 {
+			t.Fatalf("packet from device %x accepted", pkt.DeviceId)
+		}
+		ParsePacket(0, nil, buf)
+	})
+}
+
+func FuzzUnpack(f *testing.F) {
+	f.Add(fuzzPacket(f, []byte(`{"id":1,"method":"miIO.info"}`)))
+	f.Add(fuzzHello(f))
+	f.Add([]byte{0x21, 0x31, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var p Packet
+		if err := p.Unpack(buf); err != nil {
+			return
+		}
+		if p.Length < 0x20 || len(p.Data) != int(p.Length)-0x20 {
+			t.Fatalf("length %d accepted with %d bytes of data", p.Length, len(p.Data))
+		}
+	})
+}
+
+func FuzzDecrypt(f *testing.F) {
+	f.Add([]byte(`{"id":1,"result":["ok"]}`), []byte{})
+	f.Add([]byte{}, []byte{0x01, 0x02, 0x03})
+	f.Add([]byte("0123456789abcdef"), bytes.Repeat([]byte{0x10}, 32))
+
+	f.Fuzz(func(t *testing.T, payload []byte, data []byte) {
+		p, err := NewPacket(0x1234, fuzzToken, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// random data must not panic
+		p.Data = data
+		p.Decrypt()
+
+		// encrypted payload must be decrypted back
+		if err := p.Encrypt(payload); err != nil {
+			t.Fatal(err)
+		}
+		res, err := p.Decrypt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, payload) {
+			t.Fatalf("decrypted %x, want %x", res, payload)
+		}
+	})
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	valid := fuzzPacket(t, []byte(`{"id":1,"result":["ok"]}`))
+	before := RejectedPackets()
+	if pkt, err := ParsePacket(0x1234, fuzzToken, valid); err != nil || string(pkt.Data) != `{"id":1,"result":["ok"]}` {
+		t.Fatalf("valid packet: %v", err)
+	}
+	if RejectedPackets() != before {
+		t.Fatalf("valid packet counted as rejected %+v", RejectedPackets())
+	}
+
+	// changed timestamp, checksum and payload, packet with the wrong token
+	for i, offset := range []int{15, 16, len(valid) - 1, -1} {
+		buf := append([]byte(nil), valid...)
+		token := fuzzToken
+		if offset >= 0 {
+			buf[offset] ^= 0x01
+		} else {
+			token = bytes.Repeat([]byte{0x01}, 16)
+		}
+		if _, err := ParsePacket(0x1234, token, buf); err != ErrChecksumMismatch {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+	}
+	if got := RejectedPackets().Checksum - before.Checksum; got != 4 {
+		t.Fatalf("checksum counter increased by %d", got)
+	}
+}
+
+func TestDeviceIdMismatch(t *testing.T) {
+	p, err := NewPacket(0x5678, fuzzToken, 100, []byte(`{"id":1,"result":["ok"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := RejectedPackets()
+	if _, err := ParsePacket(0x1234, fuzzToken, buf); err != ErrDeviceIdMismatch {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// device id is not known before hello answer
+	if _, err := ParsePacket(0, fuzzToken, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := RejectedPackets().DeviceId - before.DeviceId; got != 1 {
+		t.Fatalf("device id counter increased by %d", got)
+	}
+}
+
+func TestRejectedPackets(t *testing.T) {
+	before := RejectedPackets()
+
+	// broken frame
+	if err := CheckFrame([]byte{0x21, 0x31, 0x00, 0x10}); err == nil {
+		t.Fatal("short packet accepted")
+	}
+
+	// right checksum of data which can't be decrypted
+	p, err := NewPacket(0x1234, fuzzToken, 100, []byte(`{"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Data = bytes.Repeat([]byte{0x01}, len(p.Data))
+	buf, err := p.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePacket(0x1234, fuzzToken, buf); err == nil {
+		t.Fatal("garbage payload decrypted")
+	}
+
+	after := RejectedPackets()
+	if after.Frame-before.Frame != 1 || after.Decrypt-before.Decrypt != 1 || after.Checksum != before.Checksum {
+		t.Fatalf("unexpected counters %+v, before %+v", after, before)
+	}
+}
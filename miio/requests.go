@@ -1,9 +1,16 @@
 package miio
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 )
 
+var (
+	ErrEmptyResponse = errors.New("empty response")
+)
+
 /*
 Valid methods with parameters:
 	"miIO.info", nil
@@ -43,25 +50,85 @@ func (r Request) String() string {
 	return fmt.Sprintf(`{"id":%d,"method":"%s","params":"%s"}`, r.Id, r.Method, r.Params)
 }
 
+// Response keeps raw json result, use DecodeResult to get typed value
 type Response struct {
-	Id     int            `json:"id"`
-	Result []string       `json:"result,omitempty"`
-	Error  *ResponseError `json:"error,omitempty"`
+	Id      int             `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *ResponseError  `json:"error,omitempty"`
+	ExeTime int             `json:"exe_time,omitempty"`
+}
+
+// ParseResponse decode device answer. Error reported by device returned as *ResponseError
+// together with response. Some devices send zero bytes after json, they are trimmed.
+func ParseResponse(data []byte) (*Response, error) {
+	data = bytes.TrimRight(data, "\x00")
+	var r *Response
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ErrEmptyResponse
+	}
+
+	if r.Error != nil {
+		return r, r.Error
+	}
+
+	return r, nil
+}
+
+// DecodeResult unmarshal result into v
+func (r *Response) DecodeResult(v interface{}) error {
+	if len(r.Result) == 0 {
+		return ErrEmptyResponse
+	}
+	return json.Unmarshal(r.Result, v)
 }
 
 func (r Response) String() string {
-	return fmt.Sprintf(`{"id":%d,"result":%v,"error":%s}`, r.Id, r.Result, r.Error.String())
+	if r.Error != nil {
+		return fmt.Sprintf(`{"id":%d,"error":%s}`, r.Id, r.Error.String())
+	}
+	return fmt.Sprintf(`{"id":%d,"result":%s}`, r.Id, r.Result)
 }
 
+// ResponseError is an error returned by device. Check it with errors.As
 type ResponseError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
 
+func (r ResponseError) Error() string {
+	return fmt.Sprintf("device error %d: %s", r.Code, r.Message)
+}
+
 func (r ResponseError) String() string {
 	return fmt.Sprintf(`{"code":%d,"message":"%s"}`, r.Code, r.Message)
 }
 
+// method = "miIO.info"
+type Info struct {
+	Model     string `json:"model"`
+	Mac       string `json:"mac"`
+	FwVer     string `json:"fw_ver"`
+	HwVer     string `json:"hw_ver"`
+	MiioVer   string `json:"miio_ver"`
+	WifiFwVer string `json:"wifi_fw_ver"`
+	Token     string `json:"token"`
+	Life      int    `json:"life"`
+	Ap        struct {
+		Ssid  string `json:"ssid"`
+		Bssid string `json:"bssid"`
+		Rssi  int    `json:"rssi"`
+		Freq  int    `json:"freq"`
+	} `json:"ap"`
+	Netif struct {
+		LocalIp string `json:"localIp"`
+		Mask    string `json:"mask"`
+		Gw      string `json:"gw"`
+	} `json:"netif"`
+}
+
 // method = "miIO.get_repeater_sta_info"
 /* todo
 "Access policy: {result.access_policy}"
@@ -91,7 +158,7 @@ type DeviceConfiguration struct {
 }
 
 func (r DeviceConfiguration) String() string {
-	return fmt.Sprintf(`{"ssid":"%s","passwd":"%s","uid":"%s"}`, r.Ssid, r.Password, r.Uid)
+	return fmt.Sprintf(`{"ssid":"%s","passwd":"%s","uid":%d}`, r.Ssid, r.Password, r.Uid)
 }
 
 // method = "miIO.switch_wifi_ssid"
@@ -0,0 +1,34 @@
+package miio
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseResponse(t *testing.T) {
+	for data, want := range map[string]string{
+		`{"id":7,"result":["ok"]}`:              `["ok"]`,
+		"{\"id\":7,\"result\":[\"on\",50]}\x00": `["on",50]`,
+		"{\"id\":7,\"result\":{}}\x00\x00\x00":  `{}`,
+	} {
+		r, err := ParseResponse([]byte(data))
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if r.Id != 7 || string(r.Result) != want {
+			t.Fatalf("%q: unexpected response %s", data, r)
+		}
+	}
+
+	r, err := ParseResponse([]byte("{\"id\":8,\"error\":{\"code\":-9999,\"message\":\"user ack timeout\"}}\x00"))
+	var re *ResponseError
+	if r == nil || r.Id != 8 || !errors.As(err, &re) || re.Code != -9999 {
+		t.Fatalf("unexpected response %v, error %v", r, err)
+	}
+
+	for _, data := range []string{"", "\x00", "null", "{\"id\":1\x00}"} {
+		if _, err := ParseResponse([]byte(data)); err == nil {
+			t.Errorf("%q: error expected", data)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+/*
+Package sim runs fake miio device on udp port to test manager without real hardware.
+
+Device answers hello with its uptime stamp, decrypts requests with the token and serves
+miIO.info, get_prop/set_<prop> from Props and get_properties/set_properties/action from
+miot spec. Any method can be scripted with Handle. Faults injects drops, delays, wrong
+checksums, duplicated and reordered answers.
+
+Manager connects to port 54321, so every simulated device should listen on its own loopback
+address, e.g. 127.0.0.2:54321.
+*/
+package sim
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/utils"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultAddr = "127.0.0.1:54321"
+
+// Handler return result or error for request
+type Handler func(method string, params json.RawMessage) (interface{}, *miio.ResponseError)
+
+type Config struct {
+	Id    uint32
+	Token []byte
+	Model string
+	Mac   string
+	Addr  string // listen address, DefaultAddr if empty
+	// RevealToken send token in hello answer like not provisioned device does
+	RevealToken bool
+	// Props served by get_prop and changed by set_<prop>
+	Props map[string]interface{}
+	// Spec used to serve miot methods
+	Spec  *miio.Details
+	Debug bool
+}
+
+type Faults struct {
+	Drop        float64       // probability to ignore request (hello is never dropped)
+	Delay       time.Duration // delay before answer
+	BadChecksum bool          // answer with broken checksum
+	Duplicate   bool          // send every answer twice
+	Reorder     bool          // hold every other answer back and send it after the next one
+}
+
+type Device struct {
+	cfg      Config
+	conn     *net.UDPConn
+	start    time.Time
+	faults   Faults
+	handlers map[string]Handler
+	props    map[string]interface{}
+	miot     map[[2]int]interface{}
+	requests []miio.Request
+	held     []byte // answer held back by Reorder, used by serve goroutine only
+	sync.Mutex
+}
+
+// Start listen udp address and serve requests until Close
+func Start(cfg Config) (*Device, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = DefaultAddr
+	}
+	if len(cfg.Token) != 16 {
+		return nil, fmt.Errorf("token should be 16 bytes")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Device{
+		cfg:      cfg,
+		conn:     conn,
+		start:    time.Now().Add(-time.Second), // stamp should not be zero
+		handlers: make(map[string]Handler),
+		props:    make(map[string]interface{}),
+		miot:     make(map[[2]int]interface{}),
+	}
+	for k, v := range cfg.Props {
+		d.props[k] = v
+	}
+	if cfg.Spec != nil {
+		for _, s := range cfg.Spec.Services {
+			for _, p := range s.Props {
+				d.miot[[2]int{s.Id, p.Id}] = defaultValue(p.Format)
+			}
+		}
+	}
+
+	go d.serve()
+	return d, nil
+}
+
+func (d *Device) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (d *Device) Close() error {
+	return d.conn.Close()
+}
+
+// SetFaults change fault injection for next requests
+func (d *Device) SetFaults(f Faults) {
+	d.Lock()
+	defer d.Unlock()
+	d.faults = f
+}
+
+// Handle script answer for method, it overrides built in methods
+func (d *Device) Handle(method string, h Handler) {
+	d.Lock()
+	defer d.Unlock()
+	d.handlers[method] = h
+}
+
+// Prop return legacy property value
+func (d *Device) Prop(name string) interface{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.props[name]
+}
+
+func (d *Device) SetProp(name string, value interface{}) {
+	d.Lock()
+	defer d.Unlock()
+	d.props[name] = value
+}
+
+// Property return miot property value
+func (d *Device) Property(siid int, piid int) interface{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.miot[[2]int{siid, piid}]
+}
+
+func (d *Device) SetProperty(siid int, piid int, value interface{}) {
+	d.Lock()
+	defer d.Unlock()
+	d.miot[[2]int{siid, piid}] = value
+}
+
+// Requests return all requests received by device
+func (d *Device) Requests() []miio.Request {
+	d.Lock()
+	defer d.Unlock()
+	return append([]miio.Request(nil), d.requests...)
+}
+
+func (d *Device) stamp() uint32 {
+	return uint32(time.Since(d.start) / time.Second)
+}
+
+func (d *Device) serve() {
+	buf := make([]byte, miio.MaxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if miio.CheckFrame(buf[:n]) != nil {
+			continue
+		}
+
+		pkt, err := miio.ParsePacket(0, nil, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if pkt.DeviceId == miio.HelloPacketDeviceId {
+			d.hello(addr)
+			continue
+		}
+
+		d.request(addr, buf[:n])
+	}
+}
+
+func (d *Device) hello(addr *net.UDPAddr) {
+	buf := make([]byte, 32)
+	offset := utils.WriteInt16(buf, 0, 0x2131)
+	offset = utils.WriteInt16(buf, offset, 0x20)
+	offset = utils.WriteInt32(buf, offset, 0)
+	offset = utils.WriteInt32(buf, offset, d.cfg.Id)
+	offset = utils.WriteInt32(buf, offset, d.stamp())
+	if d.cfg.RevealToken {
+		copy(buf[offset:], d.cfg.Token)
+	} else {
+		copy(buf[offset:], bytes.Repeat([]byte{0xff}, 16))
+	}
+	d.conn.WriteToUDP(buf, addr)
+}
+
+func (d *Device) request(addr *net.UDPAddr, buf []byte) {
+	pkt, err := miio.ParsePacket(d.cfg.Id, d.cfg.Token, buf)
+	if err != nil {
+		if d.cfg.Debug {
+			log.Println("sim: drop request", err)
+		}
+		return
+	}
+
+	var req struct {
+		Id     int             `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(pkt.Data, &req); err != nil {
+		return
+	}
+
+	d.Lock()
+	var params interface{}
+	json.Unmarshal(req.Params, &params)
+	d.requests = append(d.requests, miio.Request{Id: req.Id, Method: req.Method, Params: params})
+	faults := d.faults
+	handler := d.handlers[req.Method]
+	d.Unlock()
+
+	if faults.Drop > 0 && rand.Float64() < faults.Drop {
+		return
+	}
+
+	var result interface{}
+	var rerr *miio.ResponseError
+	if handler != nil {
+		result, rerr = handler(req.Method, req.Params)
+	} else {
+		result, rerr = d.builtin(req.Method, req.Params)
+	}
+
+	resp := map[string]interface{}{"id": req.Id}
+	if rerr != nil {
+		resp["error"] = rerr
+	} else {
+		resp["result"] = result
+	}
+	payload, _ := json.Marshal(resp)
+	if d.cfg.Debug {
+		log.Println("sim:", req.Method, string(req.Params), "->", string(payload))
+	}
+
+	p, err := miio.NewPacket(d.cfg.Id, d.cfg.Token, d.stamp(), payload)
+	if err != nil {
+		return
+	}
+	out, err := p.Pack()
+	if err != nil {
+		return
+	}
+	if faults.BadChecksum {
+		out[20] ^= 0xff
+	}
+
+	if faults.Delay > 0 {
+		time.Sleep(faults.Delay)
+	}
+	if faults.Reorder && d.held == nil {
+		d.held = out
+		return
+	}
+	d.conn.WriteToUDP(out, addr)
+	if faults.Duplicate {
+		d.conn.WriteToUDP(out, addr)
+	}
+	if d.held != nil {
+		d.conn.WriteToUDP(d.held, addr)
+		d.held = nil
+	}
+}
+
+var errNotFound = &miio.ResponseError{Code: -32601, Message: "Method not found."}
+
+func (d *Device) builtin(method string, params json.RawMessage) (interface{}, *miio.ResponseError) {
+	d.Lock()
+	defer d.Unlock()
+
+	switch {
+	case method == "miIO.info":
+		return map[string]interface{}{
+			"model":    d.cfg.Model,
+			"mac":      d.cfg.Mac,
+			"fw_ver":   "1.0.0",
+			"hw_ver":   "sim",
+			"miio_ver": "0.0.1",
+			"token":    hex.EncodeToString(d.cfg.Token),
+			"life":     d.stamp(),
+			"netif":    map[string]string{"localIp": d.Addr().IP.String(), "mask": "255.0.0.0", "gw": "127.0.0.1"},
+		}, nil
+
+	case method == "get_prop":
+		var names []string
+		if err := json.Unmarshal(params, &names); err != nil {
+			return nil, &miio.ResponseError{Code: -5001, Message: "invalid params"}
+		}
+		res := make([]interface{}, len(names))
+		for i, name := range names {
+			if v, ok := d.props[name]; ok {
+				res[i] = v
+			} else {
+				res[i] = ""
+			}
+		}
+		return res, nil
+
+	case strings.HasPrefix(method, "set_") && method != "set_properties":
+		var values []interface{}
+		if err := json.Unmarshal(params, &values); err != nil || len(values) == 0 {
+			return nil, &miio.ResponseError{Code: -5001, Message: "invalid params"}
+		}
+		d.props[strings.TrimPrefix(method, "set_")] = values[0]
+		return []string{"ok"}, nil
+
+	case method == "get_properties" && d.cfg.Spec != nil:
+		var refs []miio.PropRef
+		if err := json.Unmarshal(params, &refs); err != nil {
+			return nil, &miio.ResponseError{Code: -5001, Message: "invalid params"}
+		}
+		res := make([]map[string]interface{}, len(refs))
+		for i, r := range refs {
+			item := map[string]interface{}{"did": r.Did, "siid": r.Siid, "piid": r.Piid}
+			if p := d.property(r.Siid, r.Piid); p == nil || !p.Readable() {
+				item["code"] = -4001
+			} else {
+				item["code"] = 0
+				item["value"] = d.miot[[2]int{r.Siid, r.Piid}]
+			}
+			res[i] = item
+		}
+		return res, nil
+
+	case method == "set_properties" && d.cfg.Spec != nil:
+		var values []miio.PropValue
+		if err := json.Unmarshal(params, &values); err != nil {
+			return nil, &miio.ResponseError{Code: -5001, Message: "invalid params"}
+		}
+		res := make([]map[string]interface{}, len(values))
+		for i, v := range values {
+			item := map[string]interface{}{"did": v.Did, "siid": v.Siid, "piid": v.Piid}
+			if p := d.property(v.Siid, v.Piid); p == nil || !p.Writable() {
+				item["code"] = -4002
+			} else {
+				item["code"] = 0
+				d.miot[[2]int{v.Siid, v.Piid}] = v.Value
+			}
+			res[i] = item
+		}
+		return res, nil
+
+	case method == "action" && d.cfg.Spec != nil:
+		var a miio.ActionRequest
+		if err := json.Unmarshal(params, &a); err != nil {
+			return nil, &miio.ResponseError{Code: -5001, Message: "invalid params"}
+		}
+		for _, s := range d.cfg.Spec.Services {
+			for _, act := range s.Actions {
+				if s.Id == a.Siid && act.Id == a.Aiid {
+					return map[string]interface{}{"did": a.Did, "siid": a.Siid, "aiid": a.Aiid, "code": 0, "out": []interface{}{}}, nil
+				}
+			}
+		}
+		return map[string]interface{}{"did": a.Did, "siid": a.Siid, "aiid": a.Aiid, "code": -4003}, nil
+	}
+
+	return nil, errNotFound
+}
+
+func (d *Device) property(siid int, piid int) *miio.Property {
+	for _, s := range d.cfg.Spec.Services {
+		if s.Id != siid {
+			continue
+		}
+		for i := range s.Props {
+			if s.Props[i].Id == piid {
+				return &s.Props[i]
+			}
+		}
+	}
+	return nil
+}
+
+func defaultValue(format string) interface{} {
+	switch {
+	case format == "bool":
+		return false
+	case format == "string":
+		return ""
+	default:
+		return 0
+	}
+}
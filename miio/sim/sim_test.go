@@ -0,0 +1,126 @@
+package sim_test
+
+import (
+	"manager_xiaomi/device"
+	"manager_xiaomi/miio"
+	"manager_xiaomi/miio/sim"
+	"testing"
+)
+
+var token = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+func start(t *testing.T, cfg sim.Config) *device.MiIoDevice {
+	s, err := sim.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	dev := device.NewMiIoDevice(false, cfg.Id, "")
+	dev.Token = token
+	if err := dev.Connect(s.Addr().IP.String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+func TestInfo(t *testing.T) {
+	dev := start(t, sim.Config{Id: 0x1234, Token: token, Model: "yeelink.light.mono1", Mac: "aa:bb:cc:dd:ee:ff", Addr: "127.0.0.2:54321"})
+
+	resp, err := dev.Send("miIO.info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info miio.Info
+	if err := resp.DecodeResult(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Model != "yeelink.light.mono1" || info.Mac != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+}
+
+func TestProps(t *testing.T) {
+	dev := start(t, sim.Config{Id: 0x1235, Token: token, Addr: "127.0.0.3:54321",
+		Props: map[string]interface{}{"power": "off", "bright": 10}})
+
+	if _, err := dev.Set("power", "on"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := dev.Send("get_prop", []string{"power", "bright"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []interface{}
+	if err := resp.DecodeResult(&values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != "on" || values[1] != float64(10) {
+		t.Fatalf("unexpected values %v", values)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	s, err := sim.Start(sim.Config{Id: 0x1236, Token: token, Addr: "127.0.0.4:54321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetFaults(sim.Faults{Duplicate: true})
+
+	dev := device.NewMiIoDevice(false, 0x1236, "")
+	dev.Token = token
+	if err := dev.Connect(s.Addr().IP.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	// second answer of first request should be dropped as stale
+	for i := 0; i < 2; i++ {
+		resp, err := dev.Send("miIO.info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqs := s.Requests(); resp.Id != reqs[len(reqs)-1].Id {
+			t.Fatalf("answer id %d, last request %d", resp.Id, reqs[len(reqs)-1].Id)
+		}
+	}
+}
+
+func TestMiot(t *testing.T) {
+	spec := &miio.Details{Services: []miio.Service{{
+		Id:   2,
+		Type: "urn:miot-spec-v2:service:light:00007802:sim:1",
+		Props: []miio.Property{
+			{Id: 1, Type: "urn:miot-spec-v2:property:on:00000006:sim:1", Format: "bool", Access: []string{"read", "write"}},
+		},
+		Actions: []miio.Action{{Id: 1, Type: "urn:miot-spec-v2:action:toggle:00002811:sim:1"}},
+	}}}
+
+	s, err := sim.Start(sim.Config{Id: 0x1237, Token: token, Addr: "127.0.0.5:54321", Spec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dev := device.NewMiotDevice(false, "sim.light", "1237", "", token, spec)
+	if err := dev.Connect(s.Addr().IP.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	if _, err := dev.Set("light.on", true); err != nil {
+		t.Fatal(err)
+	}
+	if s.Property(2, 1) != true {
+		t.Fatalf("property not changed: %v", s.Property(2, 1))
+	}
+	state, err := dev.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["light.on"] != true {
+		t.Fatalf("unexpected state %v", state)
+	}
+}
@@ -0,0 +1,218 @@
+package miio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultSpecURL = "http://miot-spec.org/miot-spec-v2"
+
+var (
+	ErrSpecNotFound = errors.New("spec not found")
+	specTimeout     = time.Second * 10
+	// instances list read from disk because server was not reachable is downloaded again after this delay
+	instancesRetry = time.Minute * 10
+)
+
+/*
+SpecStore fetch miot specs and keep them on disk:
+
+	<dir>/instances.json    - list of all instances (downloaded once per process)
+	<dir>/urn/<urn>.json    - spec by urn (never changed, urn contains version)
+	<dir>/model/<model>.json - spec by model, can be put here manually for offline use
+
+Cached data returned when spec server is not reachable.
+*/
+type SpecStore struct {
+	Dir       string
+	BaseURL   string
+	client    *http.Client
+	instances *Instances // list kept for process, it is large and changes rarely
+	retry     time.Time  // next download of instances if list is read from disk, zero if it is downloaded
+	lock      sync.Mutex
+}
+
+// NewSpecStore create store. Empty dir disables disk cache, empty baseURL disables network.
+func NewSpecStore(dir string, baseURL string) *SpecStore {
+	return &SpecStore{
+		Dir:     dir,
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: specTimeout},
+	}
+}
+
+// Instances return list of all instances. List is downloaded once per process, cached copy from disk is
+// returned if download failed and download is repeated after instancesRetry.
+func (s *SpecStore) Instances() (*Instances, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.instances != nil && (s.retry.IsZero() || time.Now().Before(s.retry)) {
+		return s.instances, nil
+	}
+
+	var i *Instances
+	buf, err := s.fetch("/instances?status=all")
+	if err == nil {
+		if err = json.Unmarshal(buf, &i); err == nil && i != nil {
+			s.store("instances.json", buf)
+			s.instances, s.retry = i, time.Time{}
+			return i, nil
+		}
+	}
+
+	if s.load("instances.json", &i) == nil && i != nil {
+		log.Println("use cached instances list:", err)
+		s.instances, s.retry = i, time.Now().Add(instancesRetry)
+		return i, nil
+	}
+	if s.instances != nil {
+		s.retry = time.Now().Add(instancesRetry)
+		return s.instances, nil
+	}
+
+	if err == nil {
+		err = ErrSpecNotFound
+	}
+	return nil, err
+}
+
+// Detail return spec by urn from disk or download it
+func (s *SpecStore) Detail(urn string) (*Details, error) {
+	name := filepath.Join("urn", fileName(urn)+".json")
+
+	var d *Details
+	if s.load(name, &d) == nil && d != nil {
+		return d, nil
+	}
+
+	buf, err := s.fetch("/instance?type=" + url.QueryEscape(urn))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &d); err != nil {
+		return nil, err
+	}
+	if d == nil || d.Type == "" {
+		return nil, ErrSpecNotFound
+	}
+
+	s.store(name, buf)
+	return d, nil
+}
+
+// ModelDetail return spec by device model from disk or find urn for model and download spec
+func (s *SpecStore) ModelDetail(model string) (*Details, error) {
+	name := filepath.Join("model", fileName(model)+".json")
+
+	var d *Details
+	if s.load(name, &d) == nil && d != nil {
+		return d, nil
+	}
+
+	i, err := s.Instances()
+	if err != nil {
+		return nil, err
+	}
+
+	inst := i.Find(model)
+	if inst == nil {
+		return nil, ErrSpecNotFound
+	}
+
+	if d, err = s.Detail(inst.Type); err != nil {
+		return nil, err
+	}
+
+	// urn spec is cached already, model file point to the same data
+	if buf, err := s.read(filepath.Join("urn", fileName(inst.Type)+".json")); err == nil {
+		s.store(name, buf)
+	}
+	return d, nil
+}
+
+// Seed download specs for models to disk cache
+func (s *SpecStore) Seed(models []string) error {
+	if s.Dir == "" {
+		return fmt.Errorf("spec directory is not set")
+	}
+
+	var failed []string
+	for _, model := range models {
+		if _, err := s.ModelDetail(model); err != nil {
+			log.Println("error get spec for", model, err)
+			failed = append(failed, model)
+			continue
+		}
+		log.Println("spec cached for", model)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("specs not cached for %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+func (s *SpecStore) fetch(path string) ([]byte, error) {
+	if s.BaseURL == "" {
+		return nil, ErrSpecNotFound
+	}
+
+	response, err := s.client.Get(s.BaseURL + path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("spec server answer %s", response.Status)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+func (s *SpecStore) read(name string) ([]byte, error) {
+	if s.Dir == "" {
+		return nil, ErrSpecNotFound
+	}
+	return ioutil.ReadFile(filepath.Join(s.Dir, name))
+}
+
+func (s *SpecStore) load(name string, v interface{}) error {
+	buf, err := s.read(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// store keep data as received from server, so fields unknown to this code are not lost
+func (s *SpecStore) store(name string, buf []byte) {
+	if s.Dir == "" {
+		return
+	}
+
+	path := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Println("error create spec cache", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		log.Println("error write spec cache", err)
+	}
+}
+
+// fileName make urn or model safe to use as file name
+func fileName(s string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(s)
+}
@@ -0,0 +1,147 @@
+package miio
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	lightUrn      = "urn:miot-spec-v2:device:light:0000A001:yeelink-mono1:1"
+	plugUrn       = "urn:miot-spec-v2:device:outlet:0000A002:chuangmi-plug:1"
+	testInstances = `{"instances": [
+		{"status": "released", "model": "yeelink.light.mono1", "version": 1, "type": "` + lightUrn + `"},
+		{"status": "released", "model": "chuangmi.plug.m1", "version": 1, "type": "` + plugUrn + `"}]}`
+)
+
+// specServer serve instances list and specs of two devices and count requests by path
+type specServer struct {
+	*httptest.Server
+	requests map[string]int
+	sync.Mutex
+}
+
+func startSpecServer(t *testing.T) *specServer {
+	s := &specServer{requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		s.requests[r.URL.Path]++
+		s.Unlock()
+
+		switch {
+		case r.URL.Path == "/instances":
+			w.Write([]byte(testInstances))
+		case r.URL.Path == "/instance" && (r.URL.Query().Get("type") == lightUrn || r.URL.Query().Get("type") == plugUrn):
+			w.Write([]byte(`{"type": "` + r.URL.Query().Get("type") + `", "description": "sim", "services": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *specServer) count(path string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests[path]
+}
+
+func TestSpecFetch(t *testing.T) {
+	server := startSpecServer(t)
+	dir := t.TempDir()
+	store := NewSpecStore(dir, server.URL+"/")
+
+	for _, model := range []string{"yeelink.light.mono1", "chuangmi.plug.m1"} {
+		d, err := store.ModelDetail(model)
+		if err != nil {
+			t.Fatal(model, err)
+		}
+		if d.Type == "" {
+			t.Fatalf("%s: empty spec", model)
+		}
+	}
+	if _, err := store.ModelDetail("unknown.model.v1"); err != ErrSpecNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// instances list is downloaded once per process
+	if n := server.count("/instances"); n != 1 {
+		t.Fatalf("instances downloaded %d times", n)
+	}
+
+	for _, name := range []string{"instances.json", "urn/" + fileName(lightUrn) + ".json",
+		"model/yeelink.light.mono1.json", "model/chuangmi.plug.m1.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// spec by model is read from disk, server is not asked
+	before := server.count("/instance")
+	if _, err := NewSpecStore(dir, server.URL).ModelDetail("yeelink.light.mono1"); err != nil {
+		t.Fatal(err)
+	}
+	if server.count("/instance") != before || server.count("/instances") != 1 {
+		t.Fatal("cached spec is downloaded again")
+	}
+}
+
+func TestSpecServerDown(t *testing.T) {
+	server := startSpecServer(t)
+	dir := t.TempDir()
+	if _, err := NewSpecStore(dir, server.URL).ModelDetail("yeelink.light.mono1"); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	// everything cached is served without server
+	store := NewSpecStore(dir, server.URL)
+	if d, err := store.ModelDetail("yeelink.light.mono1"); err != nil || d.Type != lightUrn {
+		t.Fatalf("unexpected spec %+v, error %v", d, err)
+	}
+	if d, err := store.Detail(lightUrn); err != nil || d.Type != lightUrn {
+		t.Fatalf("unexpected spec %+v, error %v", d, err)
+	}
+	if i, err := store.Instances(); err != nil || i.Find("chuangmi.plug.m1") == nil {
+		t.Fatalf("unexpected instances %+v, error %v", i, err)
+	}
+	// spec which is not cached can't be found
+	if _, err := store.ModelDetail("chuangmi.plug.m1"); err == nil {
+		t.Fatal("spec found without server and cache")
+	}
+}
+
+func TestSpecCorruptCache(t *testing.T) {
+	server := startSpecServer(t)
+	dir := t.TempDir()
+	for _, name := range []string{"instances.json", "model/yeelink.light.mono1.json", "urn/" + fileName(plugUrn) + ".json"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{broken"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// broken files are not used without server
+	down := NewSpecStore(dir, "http://127.0.0.1:1")
+	if _, err := down.ModelDetail("yeelink.light.mono1"); err == nil {
+		t.Fatal("spec read from broken cache")
+	}
+	if _, err := down.Detail(plugUrn); err == nil {
+		t.Fatal("spec read from broken cache")
+	}
+
+	// broken files are downloaded again and replaced
+	store := NewSpecStore(dir, server.URL)
+	if d, err := store.ModelDetail("yeelink.light.mono1"); err != nil || d.Type != lightUrn {
+		t.Fatalf("unexpected spec %+v, error %v", d, err)
+	}
+	if d, err := store.Detail(plugUrn); err != nil || d.Type != plugUrn {
+		t.Fatalf("unexpected spec %+v, error %v", d, err)
+	}
+	if d, err := NewSpecStore(dir, "").ModelDetail("yeelink.light.mono1"); err != nil || d.Type != lightUrn {
+		t.Fatalf("cache is not repaired: %+v, error %v", d, err)
+	}
+}
@@ -0,0 +1,34 @@
+package miio
+
+import (
+	"sync/atomic"
+)
+
+// Rejected is a number of packets dropped by reason
+type Rejected struct {
+	Frame    uint64 `json:"frame"`
+	Checksum uint64 `json:"checksum"`
+	DeviceId uint64 `json:"device_id"`
+	Decrypt  uint64 `json:"decrypt"`
+}
+
+var rejected struct {
+	frame    uint64
+	checksum uint64
+	deviceId uint64
+	decrypt  uint64
+}
+
+func countReject(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// RejectedPackets return counters of packets rejected since start
+func RejectedPackets() Rejected {
+	return Rejected{
+		Frame:    atomic.LoadUint64(&rejected.frame),
+		Checksum: atomic.LoadUint64(&rejected.checksum),
+		DeviceId: atomic.LoadUint64(&rejected.deviceId),
+		Decrypt:  atomic.LoadUint64(&rejected.decrypt),
+	}
+}
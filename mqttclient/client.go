@@ -0,0 +1,229 @@
+package mqttclient
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MajaSuite/mqtt/packet"
+)
+
+// ClientConnection works the same way as github.com/MajaSuite/mqtt/client one, but allows to set
+// last will message which is sent by broker when manager disappears.
+type ClientConnection struct {
+	debug         bool
+	Receive       chan packet.Packet // messages from Broker
+	Send          chan packet.Packet // messages to Broker
+	Connected     chan bool          // signaled after reconnect, session should be restored by owner
+	Done          chan struct{}      // closed after disconnect
+	conn          net.Conn           // replaced by reconnect, read with current
+	connLock      sync.Mutex
+	reconnecting  sync.Mutex // only one of reader and writer restores broken connection
+	connectAddr   string
+	connectPacket *packet.ConnPacket
+}
+
+func Connect(addr string, clientId string, keepAlive uint16, session bool, login string, pass string,
+	will *packet.WillMessage, debug bool) (*ClientConnection, error) {
+	connPacket := packet.NewConnect()
+	connPacket.Version = 4
+	connPacket.VersionName = "MQTT"
+	connPacket.ClientID = clientId
+	connPacket.KeepAlive = keepAlive
+	connPacket.Username = login
+	connPacket.Password = pass
+	connPacket.CleanSession = !session
+	connPacket.Will = will
+
+	cc := &ClientConnection{
+		debug:         debug,
+		Receive:       make(chan packet.Packet),
+		Send:          make(chan packet.Packet, 2),
+		Connected:     make(chan bool, 1),
+		Done:          make(chan struct{}),
+		connectAddr:   addr,
+		connectPacket: connPacket,
+	}
+
+	if err := cc.connect(); err != nil {
+		return nil, err
+	}
+
+	go cc.sendout()
+	go cc.manage()
+
+	return cc, nil
+}
+
+func (cc *ClientConnection) connect() error {
+	log.Println("connect ...")
+	conn, err := net.DialTimeout("tcp4", cc.connectAddr, time.Second)
+	if err != nil {
+		return err
+	}
+
+	if err := packet.WritePacket(conn, cc.connectPacket, cc.debug); err != nil {
+		conn.Close()
+		return err
+	}
+
+	pkt, err := packet.ReadPacket(conn, cc.debug)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	connAck, ok := pkt.(*packet.ConnAckPacket)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("wrong response from server, %s", pkt.Type())
+	}
+
+	if connAck.ReturnCode != 0 {
+		packet.WritePacket(conn, packet.NewDisconnect(), cc.debug)
+		conn.Close()
+		return fmt.Errorf("wrong response from server, %d", connAck.ReturnCode)
+	}
+
+	if cc.debug {
+		log.Println("connected")
+	}
+	cc.connLock.Lock()
+	cc.conn = conn
+	cc.connLock.Unlock()
+	return nil
+}
+
+// current return working connection
+func (cc *ClientConnection) current() net.Conn {
+	cc.connLock.Lock()
+	defer cc.connLock.Unlock()
+	return cc.conn
+}
+
+// reconnect close broken connection and connect again until it works or client is disconnected. Reader and
+// writer both call it on error, connection replaced already by the other one is kept. Owner is signaled by
+// Connected to restore subscriptions.
+func (cc *ClientConnection) reconnect(broken net.Conn) {
+	cc.reconnecting.Lock()
+	defer cc.reconnecting.Unlock()
+
+	if cc.current() != broken {
+		return
+	}
+	broken.Close()
+	for {
+		select {
+		case <-cc.Done:
+			return
+		default:
+		}
+		if err := cc.connect(); err == nil {
+			break
+		}
+		select {
+		case <-cc.Done:
+			return
+		case <-time.After(time.Second * 3):
+		}
+	}
+
+	select {
+	case cc.Connected <- true:
+	default:
+	}
+}
+
+func (cc *ClientConnection) pinger() {
+	var keepAlive = time.Second*time.Duration(cc.connectPacket.KeepAlive) - 1
+	var nextPing = time.Now().Add(keepAlive)
+
+	for {
+		select {
+		case <-cc.Done:
+			if cc.debug {
+				log.Println("pinger receive stop")
+			}
+			return
+		case <-time.After(time.Second):
+		}
+		if time.Now().After(nextPing) {
+			nextPing = time.Now().Add(keepAlive)
+			select {
+			case cc.Send <- packet.NewPing():
+			case <-cc.Done:
+				return
+			}
+		}
+	}
+}
+
+func (cc *ClientConnection) sendout() {
+	go cc.pinger()
+
+	for pkt := range cc.Send {
+		conn := cc.current()
+		if pkt.Type() == packet.DISCONNECT {
+			// clean disconnect, broker doesn't send will message
+			packet.WritePacket(conn, packet.NewDisconnect(), cc.debug)
+			if cc.debug {
+				log.Println("receive disconnect packet. stop connection")
+			}
+			close(cc.Done)
+			conn.Close()
+			return
+		}
+
+		// packet is lost with broken connection, owner republish state after Connected
+		if err := packet.WritePacket(conn, pkt, cc.debug); err != nil {
+			cc.reconnect(conn)
+		}
+	}
+}
+
+func (cc *ClientConnection) manage() {
+	for {
+		conn := cc.current()
+		pkt, err := packet.ReadPacket(conn, cc.debug)
+		if err != nil {
+			select {
+			case <-cc.Done:
+				return
+			default:
+			}
+			log.Println("mqtt connection lost:", err)
+			cc.reconnect(conn)
+			continue
+		}
+
+		// manage received packet
+		switch pkt.Type() {
+		case packet.PUBLISH:
+			select {
+			case cc.Receive <- pkt:
+			case <-cc.Done:
+				return
+			}
+			switch pkt.(*packet.PublishPacket).QoS {
+			case packet.AtLeastOnce: // PUBLISH -> PUBACK
+				p := packet.NewPubAck()
+				p.Id = pkt.(*packet.PublishPacket).Id
+				cc.Send <- p
+			case packet.ExactlyOnce: // PUBLISH ->PUBREC, PUBREL - PUBCOMP
+				p := packet.NewPubRec()
+				p.Id = pkt.(*packet.PublishPacket).Id
+				cc.Send <- p
+			}
+		case packet.PUBREL:
+			// answer on PUBREC
+			p := packet.NewPubComp()
+			p.Id = pkt.(*packet.PubRelPacket).Id
+			cc.Send <- p
+		case packet.DISCONNECT:
+			cc.Send <- packet.NewDisconnect()
+			return
+		}
+	}
+}
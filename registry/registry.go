@@ -0,0 +1,411 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoPath   = errors.New("registry file is not set")
+	ErrModified = errors.New("registry file is changed by someone else, reload it first")
+)
+
+// Entry describe one known device. Id and Token stored as hex strings. Mac is set by user or token import,
+// mac found out by manager is kept in state file only, see Mac.
+type Entry struct {
+	Id    string `json:"id"`
+	Model string `json:"model"`
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token"`
+	Mac   string `json:"mac,omitempty"`
+}
+
+// learned keep values found out by manager itself. They are saved to separate state file, so registry file
+// edited by user isn't rewritten every time device is connected or request ids are reserved.
+type learned struct {
+	Mac       string `json:"mac,omitempty"`
+	RequestId int    `json:"request_id,omitempty"` // last reserved miio request id, continued after restart
+}
+
+// NormalizeId return hex device id in the form used by manager (lower case, without leading zeros).
+// Id which is not a hex number is only lowercased.
+func NormalizeId(id string) string {
+	v, err := strconv.ParseUint(id, 16, 32)
+	if err != nil {
+		return strings.ToLower(id)
+	}
+	return fmt.Sprintf("%x", v)
+}
+
+// Registry is a list of devices stored in json file between manager restarts. Mac addresses and request ids
+// learned by manager are kept in state file next to it (devices.state.json for devices.json).
+type Registry struct {
+	path    string
+	Devices []*Entry `json:"devices"`
+	learned map[string]*learned
+	saved   []byte // registry file content after Load or Save, nil if there is no file
+	sync.Mutex
+}
+
+// StatePath return state file name for registry file
+func StatePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".state.json"
+}
+
+// Load read registry and its state from files. Missing file gives empty registry which will be created on
+// first Save
+func Load(path string) (*Registry, error) {
+	r := &Registry{path: path, learned: make(map[string]*learned)}
+	if path == "" {
+		return r, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		r.saved = buf
+		if err := json.Unmarshal(buf, r); err != nil {
+			return nil, err
+		}
+	}
+
+	state, err := ioutil.ReadFile(StatePath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(state, &r.learned); err != nil {
+			return nil, fmt.Errorf("%s: %w", StatePath(path), err)
+		}
+	}
+
+	// request ids were kept in registry file before, continue them
+	var old struct {
+		Devices []struct {
+			Id        string `json:"id"`
+			RequestId int    `json:"request_id"`
+		} `json:"devices"`
+	}
+	json.Unmarshal(buf, &old)
+	for _, e := range old.Devices {
+		if l := r.learn(NormalizeId(e.Id)); e.RequestId > l.RequestId {
+			l.RequestId = e.RequestId
+		}
+	}
+
+	for _, e := range r.Devices {
+		e.Id = NormalizeId(e.Id)
+		e.Token = strings.ToLower(e.Token)
+		e.Mac = strings.ToLower(e.Mac)
+	}
+
+	return r, nil
+}
+
+// learn return learned values of device, called with r locked
+func (r *Registry) learn(id string) *learned {
+	l := r.learned[id]
+	if l == nil {
+		l = &learned{}
+		r.learned[id] = l
+	}
+	return l
+}
+
+// Save rewrite registry file. ErrModified returned if file was changed after Load or last Save, so changes made
+// by user are never overwritten.
+func (r *Registry) Save() error {
+	if r.path == "" {
+		return ErrNoPath
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	current, err := ioutil.ReadFile(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !bytes.Equal(current, r.saved) {
+		return ErrModified
+	}
+
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	// request ids of old registry file are kept in state before they are dropped from registry
+	r.saveState()
+	if err := writeFile(r.path, buf); err != nil {
+		return err
+	}
+	r.saved = buf
+	return nil
+}
+
+// saveState rewrite state file, called with r locked
+func (r *Registry) saveState() {
+	if r.path == "" {
+		return
+	}
+
+	buf, err := json.MarshalIndent(r.learned, "", "  ")
+	if err == nil {
+		err = writeFile(StatePath(r.path), append(buf, '\n'))
+	}
+	if err != nil {
+		log.Println("error save registry state", err)
+	}
+}
+
+// writeFile write data to temporary file first and rename it, file is not lost on failure
+func writeFile(path string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Find return entry by hex device id or nil
+func (r *Registry) Find(id string) *Entry {
+	r.Lock()
+	defer r.Unlock()
+
+	id = NormalizeId(id)
+	for _, e := range r.Devices {
+		if e.Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// FindByToken return entry with the same hex token or nil
+func (r *Registry) FindByToken(token string) *Entry {
+	r.Lock()
+	defer r.Unlock()
+
+	token = strings.ToLower(token)
+	for _, e := range r.Devices {
+		if token != "" && e.Token == token {
+			return e
+		}
+	}
+	return nil
+}
+
+// FindByMac return entry with the same mac address or nil
+func (r *Registry) FindByMac(mac string) *Entry {
+	r.Lock()
+	defer r.Unlock()
+
+	mac = strings.ToLower(mac)
+	for _, e := range r.Devices {
+		if mac != "" && r.mac(e) == mac {
+			return e
+		}
+	}
+	return nil
+}
+
+// Mac return mac address of device: set in registry file or learned by manager
+func (r *Registry) Mac(id string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	id = NormalizeId(id)
+	for _, e := range r.Devices {
+		if e.Id == id {
+			return r.mac(e)
+		}
+	}
+	return ""
+}
+
+// mac return mac of entry, called with r locked
+func (r *Registry) mac(e *Entry) string {
+	if e.Mac != "" {
+		return e.Mac
+	}
+	if l := r.learned[e.Id]; l != nil {
+		return l.Mac
+	}
+	return ""
+}
+
+// Rename move entry to the new device id. Return false if old id is unknown or new one already used
+func (r *Registry) Rename(oldId string, newId string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	oldId, newId = NormalizeId(oldId), NormalizeId(newId)
+	var found *Entry
+	for _, e := range r.Devices {
+		if e.Id == newId {
+			return false
+		}
+		if e.Id == oldId {
+			found = e
+		}
+	}
+	if found == nil {
+		return false
+	}
+
+	found.Id = newId
+	if l := r.learned[oldId]; l != nil {
+		delete(r.learned, oldId)
+		r.learned[newId] = l
+		r.saveState()
+	}
+	return true
+}
+
+// SetMac remember mac address found out by manager, it is saved to state file only. Return true if mac was
+// changed
+func (r *Registry) SetMac(id string, mac string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	id, mac = NormalizeId(id), strings.ToLower(mac)
+	for _, e := range r.Devices {
+		if e.Id == id {
+			l := r.learn(id)
+			if l.Mac == mac {
+				return false
+			}
+			l.Mac = mac
+			r.saveState()
+			return true
+		}
+	}
+	return false
+}
+
+// Add insert new entry or update existing one with the same id. Return true if registry was changed
+func (r *Registry) Add(entry *Entry) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	entry.Id = NormalizeId(entry.Id)
+	entry.Token = strings.ToLower(entry.Token)
+	entry.Mac = strings.ToLower(entry.Mac)
+	for i, e := range r.Devices {
+		if e.Id == entry.Id {
+			if *e == *entry {
+				return false
+			}
+			r.Devices[i] = entry
+			return true
+		}
+	}
+
+	r.Devices = append(r.Devices, entry)
+	return true
+}
+
+// Merge add entry or update existing one with the same id. Empty fields of entry keep old values. Return true if
+// registry was changed
+func (r *Registry) Merge(entry *Entry) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	entry.Id = NormalizeId(entry.Id)
+	for _, e := range r.Devices {
+		if e.Id != entry.Id {
+			continue
+		}
+		old := *e
+		if entry.Model != "" {
+			e.Model = entry.Model
+		}
+		if entry.Name != "" {
+			e.Name = entry.Name
+		}
+		if entry.Token != "" {
+			e.Token = strings.ToLower(entry.Token)
+		}
+		if entry.Mac != "" {
+			e.Mac = strings.ToLower(entry.Mac)
+		}
+		return *e != old
+	}
+
+	entry.Token = strings.ToLower(entry.Token)
+	entry.Mac = strings.ToLower(entry.Mac)
+	r.Devices = append(r.Devices, entry)
+	return true
+}
+
+// Remove delete entry by hex device id. Return true if registry was changed
+func (r *Registry) Remove(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	id = NormalizeId(id)
+	for i, e := range r.Devices {
+		if e.Id == id {
+			r.Devices = append(r.Devices[:i], r.Devices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRequestId return last reserved request id of device
+func (r *Registry) LoadRequestId(deviceId uint32) int {
+	r.Lock()
+	defer r.Unlock()
+
+	if l := r.learned[fmt.Sprintf("%x", deviceId)]; l != nil {
+		return l.RequestId
+	}
+	return 0
+}
+
+// ReserveRequestId save reserved request id of registry device to state file
+func (r *Registry) ReserveRequestId(deviceId uint32, upto int) {
+	if r.Find(fmt.Sprintf("%x", deviceId)) == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.learn(fmt.Sprintf("%x", deviceId)).RequestId = upto
+	r.saveState()
+}
+
+// List return copy of registry entries
+func (r *Registry) List() []Entry {
+	r.Lock()
+	defer r.Unlock()
+
+	res := make([]Entry, len(r.Devices))
+	for i, e := range r.Devices {
+		res[i] = *e
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	data := `{"devices": [{"id": "0A1B2C3D", "model": "yeelink.light.mono1", "name": "desk", "token": "00112233445566778899AABBCCDDEEFF"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a1b2c3d", "0a1b2c3d", "000A1B2C3D"} {
+		if e := r.Find(id); e == nil || e.Id != "a1b2c3d" || e.Name != "desk" {
+			t.Fatalf("%s: unexpected entry %+v", id, e)
+		}
+	}
+
+	// the same device added or merged with leading zeros is not duplicated
+	if !r.Merge(&Entry{Id: "0a1b2c3d", Mac: "AA:BB:CC:00:00:01"}) || len(r.Devices) != 1 {
+		t.Fatalf("merge created new entry %+v", r.List())
+	}
+	if !r.Add(&Entry{Id: "00a1b2c3d", Model: "yeelink.light.mono1", Token: "00112233445566778899aabbccddeeff"}) ||
+		len(r.Devices) != 1 {
+		t.Fatalf("add created new entry %+v", r.List())
+	}
+	if !r.SetMac("0a1b2c3d", "aa:bb:cc:00:00:02") || r.Mac("a1b2c3d") != "aa:bb:cc:00:00:02" ||
+		r.Find("a1b2c3d").Mac != "" || r.FindByMac("AA:BB:CC:00:00:02") == nil {
+		t.Fatalf("mac is not set %+v", r.List())
+	}
+	if !r.Remove("0a1b2c3d") || len(r.Devices) != 0 {
+		t.Fatalf("entry is not removed %+v", r.List())
+	}
+
+	if id := NormalizeId("not-hex"); id != "not-hex" {
+		t.Fatalf("unexpected id %q", id)
+	}
+}
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	data := `{"devices": [{"id": "1a2b", "model": "yeelink.light.mono1", "token": "00112233445566778899aabbccddeeff", "request_id": 300}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// request id kept in registry file by old version is continued
+	if id := r.LoadRequestId(0x1a2b); id != 300 {
+		t.Fatalf("unexpected request id %d", id)
+	}
+
+	// learned values go to state file, registry file is not touched
+	r.ReserveRequestId(0x1a2b, 400)
+	r.ReserveRequestId(0x3c4d, 100) // not in registry
+	if !r.SetMac("1a2b", "AA:BB:CC:00:00:01") {
+		t.Fatal("mac is not set")
+	}
+	if buf, _ := os.ReadFile(path); string(buf) != data {
+		t.Fatalf("registry file is changed: %s", buf)
+	}
+	if StatePath(path) != filepath.Join(filepath.Dir(path), "devices.state.json") {
+		t.Fatalf("unexpected state path %s", StatePath(path))
+	}
+
+	r, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := r.Find("1a2b"); e == nil || e.Mac != "" || r.Mac("1a2b") != "aa:bb:cc:00:00:01" ||
+		r.FindByMac("aa:bb:cc:00:00:01") != e || r.LoadRequestId(0x1a2b) != 400 || r.LoadRequestId(0x3c4d) != 0 {
+		t.Fatalf("state is not restored %+v, request id %d", e, r.LoadRequestId(0x1a2b))
+	}
+
+	// learned mac is not written to registry file on save
+	r.Merge(&Entry{Id: "1a2b", Name: "desk"})
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := os.ReadFile(path); strings.Contains(string(buf), "aa:bb:cc") {
+		t.Fatalf("learned mac is saved to registry file: %s", buf)
+	}
+
+	// file edited by user after load is not overwritten
+	edited := `{"devices": []}`
+	if err := os.WriteFile(path, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.Merge(&Entry{Id: "5e6f", Model: "yeelink.light.mono1"})
+	if err := r.Save(); !errors.Is(err, ErrModified) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if buf, _ := os.ReadFile(path); string(buf) != edited {
+		t.Fatalf("edited registry file is overwritten: %s", buf)
+	}
+
+	r, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Merge(&Entry{Id: "5e6f", Model: "yeelink.light.mono1"})
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Save(); err != nil {
+		t.Fatalf("second save: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Package tokens read device tokens saved by Mi Home application:
+
+	Android miio2.db            table devicerecord, plain hex tokens
+	iOS <uid>_mihome.sqlite     table ZDEVICE, tokens encrypted with AES-ECB
+	iOS backup directory        _mihome.sqlite is found with Manifest.db
+	Android backup (adb backup) miio2.db is taken from unencrypted .ab or tar archive
+*/
+package tokens
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+var (
+	ErrUnknownFormat   = errors.New("unknown file format")
+	ErrEncryptedBackup = errors.New("encrypted android backup is not supported, make backup without password")
+	ErrNoDatabase      = errors.New("mi home database not found")
+
+	// iosKey used by Mi Home for iOS to encrypt ZTOKEN column, AES-128 key of zero bytes
+	iosKey = make([]byte, 16)
+)
+
+const (
+	sqliteMagic  = "SQLite format 3\x00"
+	androidMagic = "ANDROID BACKUP\n"
+)
+
+type Device struct {
+	Did   string `json:"did"`
+	Model string `json:"model"`
+	Name  string `json:"name"`
+	Ip    string `json:"ip"`
+	Mac   string `json:"mac"`
+	Token string `json:"token"`
+}
+
+// Id return miio device id. Bluetooth and zigbee sub devices have no miio id.
+func (d *Device) Id() (uint32, bool) {
+	id, err := strconv.ParseUint(d.Did, 10, 32)
+	return uint32(id), err == nil
+}
+
+// Read detect file type and return devices with tokens
+func Read(path string) ([]Device, error) {
+	if st, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if st.IsDir() {
+		return ReadIOSBackup(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(f, header)
+	f.Close()
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte(sqliteMagic)):
+		return ReadDatabase(path)
+	case bytes.HasPrefix(header, []byte(androidMagic)):
+		return ReadAndroidBackup(path)
+	case n >= 262 && string(header[257:262]) == "ustar":
+		return ReadAndroidBackup(path)
+	}
+
+	return nil, fmt.Errorf("%s: %w", path, ErrUnknownFormat)
+}
+
+// ReadDatabase read android miio2.db or ios _mihome.sqlite
+func ReadDatabase(path string) ([]Device, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var table string
+	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name IN ('devicerecord','ZDEVICE')`).
+		Scan(&table)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoDatabase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if table == "devicerecord" {
+		return readDevices(db, `SELECT did, model, name, localIP, mac, token FROM devicerecord`, nil)
+	}
+	return readDevices(db, `SELECT ZDID, ZMODEL, ZNAME, ZLOCALIP, ZMAC, ZTOKEN FROM ZDEVICE`, decryptToken)
+}
+
+func readDevices(db *sql.DB, query string, decrypt func(string) (string, error)) ([]Device, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Device
+	for rows.Next() {
+		var did, model, name, ip, mac, token sql.NullString
+		if err := rows.Scan(&did, &model, &name, &ip, &mac, &token); err != nil {
+			return nil, err
+		}
+		d := Device{Did: did.String, Model: model.String, Name: name.String, Ip: ip.String, Mac: mac.String,
+			Token: strings.ToLower(token.String)}
+		if decrypt != nil && d.Token != "" {
+			if d.Token, err = decrypt(d.Token); err != nil {
+				return nil, fmt.Errorf("device %s: %w", d.Did, err)
+			}
+		}
+		res = append(res, d)
+	}
+
+	return res, rows.Err()
+}
+
+// decryptToken decode ZTOKEN column: hex of AES-128-ECB encrypted hex token. First two blocks are the token,
+// padding block after them is ignored like python-miio does.
+func decryptToken(s string) (string, error) {
+	if len(s) == 32 {
+		// old application versions keep token as is
+		return s, nil
+	}
+
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("wrong encrypted token %q", s)
+	}
+
+	block, err := aes.NewCipher(iosKey)
+	if err != nil {
+		return "", err
+	}
+	data = data[:2*aes.BlockSize]
+	for i := 0; i < len(data); i += aes.BlockSize {
+		block.Decrypt(data[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+	}
+
+	token := string(data)
+	if _, err := hex.DecodeString(token); err != nil {
+		return "", fmt.Errorf("wrong decrypted token")
+	}
+
+	return token, nil
+}
+
+// ReadIOSBackup find _mihome.sqlite in unencrypted iOS backup directory using Manifest.db
+func ReadIOSBackup(dir string) ([]Device, error) {
+	manifest := filepath.Join(dir, "Manifest.db")
+	if _, err := os.Stat(manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, ErrUnknownFormat)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+manifest+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT fileID FROM Files WHERE relativePath LIKE '%_mihome.sqlite'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Device
+	found := false
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil || len(id) < 2 {
+			continue
+		}
+		devices, err := ReadDatabase(filepath.Join(dir, id[:2], id))
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		res = append(res, devices...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: %w", dir, ErrNoDatabase)
+	}
+
+	return res, nil
+}
+
+// ReadAndroidBackup extract miio2.db from adb backup (.ab) or tar archive and read it
+func ReadAndroidBackup(path string) ([]Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var archive io.Reader = r
+	if head, _ := r.Peek(len(androidMagic)); string(head) == androidMagic {
+		if archive, err = unpackBackup(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	tmp, err := os.MkdirTemp("", "miio")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var res []Device
+	found := false
+	tr := tar.NewReader(archive)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if filepath.Base(h.Name) != "miio2.db" {
+			continue
+		}
+
+		db := filepath.Join(tmp, "miio2.db")
+		out, err := os.Create(db)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		devices, err := ReadDatabase(db)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		res = append(res, devices...)
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoDatabase)
+	}
+
+	return res, nil
+}
+
+// unpackBackup skip adb backup header: magic, version, compression flag and encryption
+func unpackBackup(r *bufio.Reader) (io.Reader, error) {
+	var header [4]string
+	for i := range header {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, ErrUnknownFormat
+		}
+		header[i] = strings.TrimSuffix(line, "\n")
+	}
+
+	if header[3] != "none" {
+		return nil, ErrEncryptedBackup
+	}
+	if header[2] == "1" {
+		return zlib.NewReader(r)
+	}
+	return r, nil
+}
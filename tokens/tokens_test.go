@@ -0,0 +1,154 @@
+package tokens
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testToken = "00112233445566778899aabbccddeeff"
+
+// ZTOKEN of testToken as stored by Mi Home for iOS: AES-128-ECB with zero key, pkcs7 padded
+// (printf 00112233445566778899aabbccddeeff | openssl enc -aes-128-ecb -K 00000000000000000000000000000000)
+const testZToken = "33990d1a77737e5f93337b7f60880f7711a8e945937ce8136da08d4c9a0793fe0143db63ee66b0cdff9f69917680151e"
+
+func createDb(t *testing.T, path string, queries ...string) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+	}
+}
+
+func createAndroidDb(t *testing.T, path string) {
+	createDb(t, path,
+		`CREATE TABLE devicerecord (did TEXT, model TEXT, name TEXT, localIP TEXT, mac TEXT, token TEXT, ssid TEXT)`,
+		`INSERT INTO devicerecord VALUES ('305419896', 'yeelink.light.mono1', 'desk', '10.0.0.5', 'AA:BB:CC:DD:EE:FF', '`+testToken+`', 'home')`,
+		`INSERT INTO devicerecord VALUES ('blt.3.abc', 'xiaomi.ble.sensor', 'sensor', NULL, NULL, '', NULL)`)
+}
+
+func TestDecryptToken(t *testing.T) {
+	for ztoken, want := range map[string]string{
+		testZToken:      testToken,
+		testZToken[:64]: testToken, // without padding block
+		testToken:       testToken, // old application versions keep plain token
+		"11a8e945937ce8136da08d4c9a0793fe" + "xx": "",
+		testZToken[32:96]:                         "",
+	} {
+		token, err := decryptToken(ztoken)
+		if token != want || (err == nil) != (want != "") {
+			t.Errorf("%s: token %q, error %v", ztoken, token, err)
+		}
+	}
+}
+
+func check(t *testing.T, devices []Device, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) == 0 {
+		t.Fatal("no devices")
+	}
+	d := devices[0]
+	if id, ok := d.Id(); !ok || id != 0x12345678 || d.Token != testToken || d.Model != "yeelink.light.mono1" {
+		t.Fatalf("unexpected device %+v", d)
+	}
+}
+
+func TestAndroid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "miio2.db")
+	createAndroidDb(t, path)
+
+	devices, err := Read(path)
+	check(t, devices, err)
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	}
+	if _, ok := devices[1].Id(); ok {
+		t.Fatal("bluetooth device has miio id")
+	}
+}
+
+func TestIOS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "123_mihome.sqlite")
+	createDb(t, path,
+		`CREATE TABLE ZDEVICE (Z_PK INTEGER PRIMARY KEY, ZDID VARCHAR, ZMODEL VARCHAR, ZNAME VARCHAR, ZLOCALIP VARCHAR, ZMAC VARCHAR, ZTOKEN VARCHAR)`,
+		`INSERT INTO ZDEVICE VALUES (1, '305419896', 'yeelink.light.mono1', 'desk', '10.0.0.5', 'AA:BB:CC:DD:EE:FF', '`+testZToken+`')`)
+
+	devices, err := Read(path)
+	check(t, devices, err)
+}
+
+func TestIOSBackup(t *testing.T) {
+	dir := t.TempDir()
+	id := "d1f062e2da26192a6625d968274bfda8d07821e4"
+	os.Mkdir(filepath.Join(dir, id[:2]), 0755)
+	createDb(t, filepath.Join(dir, id[:2], id),
+		`CREATE TABLE ZDEVICE (Z_PK INTEGER PRIMARY KEY, ZDID VARCHAR, ZMODEL VARCHAR, ZNAME VARCHAR, ZLOCALIP VARCHAR, ZMAC VARCHAR, ZTOKEN VARCHAR)`,
+		`INSERT INTO ZDEVICE VALUES (1, '305419896', 'yeelink.light.mono1', 'desk', '10.0.0.5', '', '`+testZToken+`')`)
+	createDb(t, filepath.Join(dir, "Manifest.db"),
+		`CREATE TABLE Files (fileID TEXT PRIMARY KEY, domain TEXT, relativePath TEXT, flags INTEGER, file BLOB)`,
+		`INSERT INTO Files VALUES ('`+id+`', 'AppDomain-com.xiaomi.mihome', 'Documents/123_mihome.sqlite', 1, NULL)`)
+
+	devices, err := Read(dir)
+	check(t, devices, err)
+}
+
+func archive(t *testing.T, db string) []byte {
+	data, err := os.ReadFile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "apps/com.xiaomi.smarthome/_manifest", Mode: 0600, Size: 1})
+	tw.Write([]byte{0})
+	tw.WriteHeader(&tar.Header{Name: "apps/com.xiaomi.smarthome/db/miio2.db", Mode: 0600, Size: int64(len(data))})
+	tw.Write(data)
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestAndroidBackup(t *testing.T) {
+	dir := t.TempDir()
+	createAndroidDb(t, filepath.Join(dir, "miio2.db"))
+	tarball := archive(t, filepath.Join(dir, "miio2.db"))
+
+	var ab bytes.Buffer
+	ab.WriteString("ANDROID BACKUP\n5\n1\nnone\n")
+	zw := zlib.NewWriter(&ab)
+	zw.Write(tarball)
+	zw.Close()
+
+	os.WriteFile(filepath.Join(dir, "backup.ab"), ab.Bytes(), 0644)
+	devices, err := Read(filepath.Join(dir, "backup.ab"))
+	check(t, devices, err)
+
+	os.WriteFile(filepath.Join(dir, "backup.tar"), tarball, 0644)
+	devices, err = Read(filepath.Join(dir, "backup.tar"))
+	check(t, devices, err)
+
+	os.WriteFile(filepath.Join(dir, "secret.ab"), []byte("ANDROID BACKUP\n5\n1\nAES-256\n"), 0644)
+	if _, err := Read(filepath.Join(dir, "secret.ab")); !errors.Is(err, ErrEncryptedBackup) {
+		t.Fatalf("expected ErrEncryptedBackup, got %v", err)
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	os.WriteFile(path, []byte(`{"devices":[]}`), 0644)
+	if _, err := Read(path); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("expected ErrUnknownFormat, got %v", err)
+	}
+}